@@ -0,0 +1,172 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/mhkarimi1383/pg_pro/types"
+)
+
+const (
+	SCRAMSHA256     = "SCRAM-SHA-256"
+	SCRAMSHA256Plus = "SCRAM-SHA-256-PLUS"
+
+	scramNonceLength          = 18
+	scramChannelBindingMethod = "tls-server-end-point"
+)
+
+var ErrSCRAMAuthFailed = errors.New("SCRAM authentication failed")
+
+// scramServerNonce generates the server part of nonces
+var scramServerNonce = func() (string, error) {
+	nonce := make([]byte, scramNonceLength)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(nonce), nil
+}
+
+// SCRAMServer is the server side of a single SCRAM-SHA-256 exchange
+// (RFC 5802 and RFC 7677) as postgres does it
+type SCRAMServer struct {
+	verifier *types.SCRAMVerifier
+	// channelBinding is the `tls-server-end-point` data of the connection,
+	// nil when client is not using TLS
+	channelBinding []byte
+
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+}
+
+func NewSCRAMServer(verifier *types.SCRAMVerifier, channelBinding []byte) *SCRAMServer {
+	return &SCRAMServer{
+		verifier:       verifier,
+		channelBinding: channelBinding,
+	}
+}
+
+// Mechanisms returns SASL mechanisms that could be offered to the client
+func (s *SCRAMServer) Mechanisms() []string {
+	if s.channelBinding != nil {
+		return []string{SCRAMSHA256Plus, SCRAMSHA256}
+	}
+	return []string{SCRAMSHA256}
+}
+
+// ServerFirst handles the client-first-message and returns the
+// server-first-message
+func (s *SCRAMServer) ServerFirst(mechanism string, clientFirst []byte) ([]byte, error) {
+	if mechanism != SCRAMSHA256 && !(mechanism == SCRAMSHA256Plus && s.channelBinding != nil) {
+		return nil, errors.Errorf("unsupported SASL mechanism %q", mechanism)
+	}
+
+	// gs2-header is `<cbind-flag>,[authzid],` and the rest is client-first-message-bare
+	parts := strings.SplitN(string(clientFirst), ",", 3)
+	if len(parts) != 3 {
+		return nil, errors.New("malformed SCRAM client-first-message")
+	}
+	switch cbindFlag := parts[0]; {
+	case cbindFlag == "n":
+	case cbindFlag == "y":
+		if s.channelBinding != nil {
+			// client supports channel binding and thinks we don't, someone
+			// is downgrading the connection
+			return nil, errors.New("SCRAM channel binding negotiation error")
+		}
+	case cbindFlag == "p="+scramChannelBindingMethod:
+		if mechanism != SCRAMSHA256Plus {
+			return nil, errors.New("SCRAM channel binding requested without the -PLUS mechanism")
+		}
+	default:
+		return nil, errors.Errorf("unsupported SCRAM channel binding flag %q", cbindFlag)
+	}
+	if mechanism == SCRAMSHA256Plus && !strings.HasPrefix(parts[0], "p=") {
+		return nil, errors.New("SCRAM -PLUS mechanism requires channel binding")
+	}
+	if parts[1] != "" {
+		return nil, errors.New("SCRAM authorization identity is not supported")
+	}
+
+	s.gs2Header = parts[0] + "," + parts[1] + ","
+	s.clientFirstBare = parts[2]
+
+	clientNonce := ""
+	for _, attr := range strings.Split(s.clientFirstBare, ",") {
+		if strings.HasPrefix(attr, "r=") {
+			clientNonce = attr[2:]
+		}
+	}
+	if clientNonce == "" {
+		return nil, errors.New("SCRAM client nonce is missing")
+	}
+
+	serverNonce, err := scramServerNonce()
+	if err != nil {
+		return nil, err
+	}
+	s.nonce = clientNonce + serverNonce
+	s.serverFirst = fmt.Sprintf(
+		"r=%v,s=%v,i=%v",
+		s.nonce,
+		base64.StdEncoding.EncodeToString(s.verifier.Salt),
+		s.verifier.Iterations,
+	)
+	return []byte(s.serverFirst), nil
+}
+
+// ServerFinal validates the client-final-message and returns the
+// server-final-message
+func (s *SCRAMServer) ServerFinal(clientFinal []byte) ([]byte, error) {
+	msg := string(clientFinal)
+	proofIndex := strings.LastIndex(msg, ",p=")
+	if proofIndex < 0 {
+		return nil, errors.New("SCRAM client proof is missing")
+	}
+	withoutProof := msg[:proofIndex]
+	proof, err := base64.StdEncoding.DecodeString(msg[proofIndex+3:])
+	if err != nil || len(proof) != sha256.Size {
+		return nil, errors.New("malformed SCRAM client proof")
+	}
+
+	var channelBinding, nonce string
+	for _, attr := range strings.Split(withoutProof, ",") {
+		switch {
+		case strings.HasPrefix(attr, "c="):
+			channelBinding = attr[2:]
+		case strings.HasPrefix(attr, "r="):
+			nonce = attr[2:]
+		}
+	}
+
+	expectedBinding := []byte(s.gs2Header)
+	if strings.HasPrefix(s.gs2Header, "p=") {
+		expectedBinding = append(expectedBinding, s.channelBinding...)
+	}
+	if channelBinding != base64.StdEncoding.EncodeToString(expectedBinding) {
+		return nil, errors.New("SCRAM channel binding check failed")
+	}
+	if nonce != s.nonce {
+		return nil, errors.New("SCRAM nonce mismatch")
+	}
+
+	authMessage := s.clientFirstBare + "," + s.serverFirst + "," + withoutProof
+	clientSignature := s.verifier.ClientSignature(authMessage)
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if !hmac.Equal(storedKey[:], s.verifier.StoredKey) {
+		return nil, ErrSCRAMAuthFailed
+	}
+
+	return []byte("v=" + base64.StdEncoding.EncodeToString(s.verifier.ServerSignature(authMessage))), nil
+}
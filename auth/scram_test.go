@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/pbkdf2"
+
+	_ "github.com/mhkarimi1383/pg_pro/config/configtest"
+	"github.com/mhkarimi1383/pg_pro/types"
+)
+
+// test vector of RFC 7677 (section 3)
+const (
+	rfc7677ClientFirst = "n,,n=user,r=rOprNGfwEbeRWgbNEkqO"
+	rfc7677ServerNonce = "%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+	rfc7677ServerFirst = "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	rfc7677ClientFinal = "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	rfc7677ServerFinal = "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+)
+
+func rfc7677Verifier(t *testing.T) *types.SCRAMVerifier {
+	salt, err := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saltedPassword := pbkdf2.Key([]byte("pencil"), salt, 4096, sha256.Size, sha256.New)
+	key := func(name string) []byte {
+		mac := hmac.New(sha256.New, saltedPassword)
+		mac.Write([]byte(name))
+		return mac.Sum(nil)
+	}
+	storedKey := sha256.Sum256(key("Client Key"))
+	return &types.SCRAMVerifier{
+		Iterations: 4096,
+		Salt:       salt,
+		StoredKey:  storedKey[:],
+		ServerKey:  key("Server Key"),
+	}
+}
+
+func TestSCRAMServerRFC7677(t *testing.T) {
+	defer func(generate func() (string, error)) { scramServerNonce = generate }(scramServerNonce)
+	scramServerNonce = func() (string, error) { return rfc7677ServerNonce, nil }
+
+	tests := []struct {
+		name        string
+		mechanism   string
+		clientFirst string
+		clientFinal string
+		serverFinal string
+		err         error
+	}{
+		{
+			name:        "valid proof",
+			mechanism:   SCRAMSHA256,
+			clientFirst: rfc7677ClientFirst,
+			clientFinal: rfc7677ClientFinal,
+			serverFinal: rfc7677ServerFinal,
+		},
+		{
+			name:        "wrong proof",
+			mechanism:   SCRAMSHA256,
+			clientFirst: rfc7677ClientFirst,
+			clientFinal: "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",
+			err:         ErrSCRAMAuthFailed,
+		},
+		{
+			name:        "wrong nonce",
+			mechanism:   SCRAMSHA256,
+			clientFirst: rfc7677ClientFirst,
+			clientFinal: "c=biws,r=rOprNGfwEbeRWgbNEkqO,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+			err:         errors.New("SCRAM nonce mismatch"),
+		},
+		{
+			name:        "wrong channel binding",
+			mechanism:   SCRAMSHA256,
+			clientFirst: rfc7677ClientFirst,
+			clientFinal: "c=eSws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+			err:         errors.New("SCRAM channel binding check failed"),
+		},
+		{
+			name:        "plus mechanism without TLS",
+			mechanism:   SCRAMSHA256Plus,
+			clientFirst: rfc7677ClientFirst,
+			err:         errors.New(`unsupported SASL mechanism "SCRAM-SHA-256-PLUS"`),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSCRAMServer(rfc7677Verifier(t), nil)
+			serverFirst, err := s.ServerFirst(tt.mechanism, []byte(tt.clientFirst))
+			if err == nil {
+				if string(serverFirst) != rfc7677ServerFirst {
+					t.Fatalf("server-first-message = %q, want %q", serverFirst, rfc7677ServerFirst)
+				}
+				var serverFinal []byte
+				serverFinal, err = s.ServerFinal([]byte(tt.clientFinal))
+				if err == nil && string(serverFinal) != tt.serverFinal {
+					t.Fatalf("server-final-message = %q, want %q", serverFinal, tt.serverFinal)
+				}
+			}
+			switch {
+			case tt.err == nil && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.err != nil && (err == nil || err.Error() != tt.err.Error()):
+				t.Fatalf("error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
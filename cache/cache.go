@@ -1,9 +1,7 @@
 package cache
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
 	"time"
 
 	"github.com/allegro/bigcache/v3"
@@ -31,27 +29,51 @@ import (
 	"github.com/mhkarimi1383/pg_pro/types"
 )
 
-type cacheType []byte
+type cacheType = []byte
 
 var (
+	// staleWhileRevalidate is how long expired results are served while they
+	// are refreshed in background
+	staleWhileRevalidate = config.GetDuration("cache.stale_while_revalidate") * time.Second
+
 	ctx          context.Context
-	cacheManager *cache.Cache[cacheType] // We are converting data to `[]byte` using `gob`, to be compatible with all of the cache backends
+	cacheManager *cache.Cache[cacheType] // We are converting data to `[]byte` (see encoding.go), to be compatible with all of the cache backends
+	// localCache is the optional in-memory cache in front of cacheManager,
+	// entries are kept there for at most localTTL
+	localCache *cache.Cache[cacheType]
+	localTTL   time.Duration
 )
 
 func init() {
 	ctx = context.Background()
+	cacheManager = newCache("cache")
+	if config.Get("cache.l1") != nil {
+		localCache = newCache("cache.l1")
+		localTTL = config.GetDuration("cache.l1.ttl") * time.Second
+		startPubSub()
+	}
+}
+
+// newCache creates the cache configured in the given section of config
+func newCache(section string) *cache.Cache[cacheType] {
 	storeOpts := []store.Option{
-		store.WithExpiration(config.GetDuration("cache.ttl") * time.Second),
+		store.WithExpiration(config.GetDuration(section+".ttl") * time.Second),
 	}
-	switch config.GetString("cache.backend") {
+	switch config.GetString(section + ".backend") {
 	case "memcached":
 		memcacheStore := memcache_store.NewMemcache(
-			memcache.New(config.GetStringSlice("cache.connection_info")...),
+			memcache.New(config.GetStringSlice(section+".connection_info")...),
 			storeOpts...,
 		)
-		cacheManager = cache.New[cacheType](memcacheStore)
+		return cache.New[cacheType](memcacheStore)
 	case "bigcache":
-		bigCacheClient, err := bigcache.New(ctx, bigcache.DefaultConfig(config.GetDuration("cache.ttl")+5*time.Second))
+		// bigcache keeps every entry for the same life window, so it has to
+		// fit the longest policy (TTLs of query hints beyond it are cut short)
+		lifeWindow := config.GetDuration(section+".ttl") * time.Second
+		if section == "cache" {
+			lifeWindow = maxPolicyTTL() + staleWhileRevalidate
+		}
+		bigCacheClient, err := bigcache.New(ctx, bigcache.DefaultConfig(lifeWindow))
 		if err != nil {
 			panic(errors.Wrap(err, "inializing bigcache client"))
 		}
@@ -59,59 +81,59 @@ func init() {
 			bigCacheClient,
 			storeOpts...,
 		)
-		cacheManager = cache.New[cacheType](bigcacheStore)
+		return cache.New[cacheType](bigcacheStore)
 	case "freecache":
 		freecacheStore := freecache_store.NewFreecache(
-			freecache.NewCache(config.GetInt("cache.connection_info")),
+			freecache.NewCache(config.GetInt(section+".connection_info")),
 			storeOpts...,
 		)
-		cacheManager = cache.New[cacheType](freecacheStore)
+		return cache.New[cacheType](freecacheStore)
 	case "go-cache":
 		gocacheStore := go_cache_store.NewGoCache(
-			go_cache.New(config.GetDuration("cache.ttl")+5*time.Second, config.GetDuration("cache.connection_info")+5*time.Second),
+			go_cache.New(config.GetDuration(section+".ttl")*time.Second, config.GetDuration(section+".connection_info")*time.Second),
 			storeOpts...,
 		)
-		cacheManager = cache.New[cacheType](gocacheStore)
+		return cache.New[cacheType](gocacheStore)
 	case "pegasus":
 		pegasusStore, err := pegasus_store.NewPegasus(
 			ctx,
 			&pegasus_store.OptionsPegasus{
-				MetaServers: config.GetStringSlice("cache.connection_info"),
+				MetaServers: config.GetStringSlice(section + ".connection_info"),
 				Options: &store.Options{
-					Expiration: config.GetDuration("cache.ttl") * time.Second,
+					Expiration: config.GetDuration(section+".ttl") * time.Second,
 				},
 			},
 		)
 		if err != nil {
 			panic(errors.Wrap(err, "inializing pegasus client"))
 		}
-		cacheManager = cache.New[cacheType](pegasusStore)
+		return cache.New[cacheType](pegasusStore)
 	case "redis":
 		redisStore := redis_store.NewRedis(
 			redis.NewClient(&redis.Options{
-				Addr:     config.GetString("cache.connection_info.addr"),
-				Password: config.GetString("cache.connection_info.password"),
-				DB:       config.GetInt("cache.connection_info.db"),
+				Addr:     config.GetString(section + ".connection_info.addr"),
+				Password: config.GetString(section + ".connection_info.password"),
+				DB:       config.GetInt(section + ".connection_info.db"),
 			}),
 			storeOpts...,
 		)
-		cacheManager = cache.New[cacheType](redisStore)
+		return cache.New[cacheType](redisStore)
 	case "rediscluster":
 		redisclusterStore := rediscluster_store.NewRedisCluster(
 			v8_redis.NewClusterClient(
 				&v8_redis.ClusterOptions{
-					Addrs:    config.GetStringSlice("cache.connection_info.addrs"),
-					Password: config.GetString("cache.connection_info.password"),
+					Addrs:    config.GetStringSlice(section + ".connection_info.addrs"),
+					Password: config.GetString(section + ".connection_info.password"),
 				},
 			),
 			storeOpts...,
 		)
-		cacheManager = cache.New[cacheType](redisclusterStore)
+		return cache.New[cacheType](redisclusterStore)
 	case "ristretto":
 		ristrettoClient, err := ristretto.NewCache(&ristretto.Config{
-			NumCounters: config.GetInt64("cache.connection_info.max_counter"),
-			MaxCost:     config.GetInt64("cache.connection_info.max_cost"),
-			BufferItems: config.GetInt64("cache.connection_info.buffer_items"),
+			NumCounters: config.GetInt64(section + ".connection_info.max_counter"),
+			MaxCost:     config.GetInt64(section + ".connection_info.max_cost"),
+			BufferItems: config.GetInt64(section + ".connection_info.buffer_items"),
 		})
 		if err != nil {
 			panic(errors.Wrap(err, "inializing ristretto client"))
@@ -120,11 +142,11 @@ func init() {
 			ristrettoClient,
 			storeOpts...,
 		)
-		cacheManager = cache.New[cacheType](ristrettoStore)
+		return cache.New[cacheType](ristrettoStore)
 	case "rueidis":
 		rueidisclient, err := rueidis.NewClient(rueidis.ClientOption{
-			InitAddress: config.GetStringSlice("cache.connection_info.addrs"),
-			Password:    config.GetString("cache.connection_info.password"),
+			InitAddress: config.GetStringSlice(section + ".connection_info.addrs"),
+			Password:    config.GetString(section + ".connection_info.password"),
 		})
 		if err != nil {
 			panic(err)
@@ -133,40 +155,73 @@ func init() {
 			rueidisclient,
 			storeOpts...,
 		)
-		cacheManager = cache.New[cacheType](rueidisStore)
+		return cache.New[cacheType](rueidisStore)
 	default:
 		panic("invalid cache backend")
 	}
-	if cacheManager == nil {
-		panic("invalid cache backend or invalid configuration")
-	}
 }
 
-func Get(q string) (result *types.QueryResult, err error) {
-	value, err := cacheManager.Get(ctx, []byte(q))
-	if err != nil {
-		return
+// Get returns a cached result, stale is true when the result is expired and
+// only served because of stale-while-revalidate. Entries are checked against
+// known invalidations too, since they could be missed by invalidating tags.
+func Get(key *Key) (result *types.QueryResult, stale bool, err error) {
+	k := key.String()
+	var e *entry
+	if localCache != nil {
+		if value, err := localCache.Get(ctx, k); err == nil {
+			e, _ = decodeEntry(value)
+		}
 	}
-	gres := types.QueryResult{}
-	reader := bytes.NewReader(value)
-	dec := gob.NewDecoder(reader)
-	if err := dec.Decode(&gres); err != nil {
-		return nil, err
+	if e == nil {
+		value, err := cacheManager.Get(ctx, k)
+		if err != nil {
+			return nil, false, err
+		}
+		if e, err = decodeEntry(value); err != nil {
+			// entries written by other versions of pg_pro are just misses
+			return nil, false, errors.Wrap(err, "decoding cached result")
+		}
+		if invalidatedSince(key.Database, e.Tables, e.ReadAt, e.LSN) {
+			return nil, false, nil
+		}
+		if localCache != nil {
+			_ = localCache.Set(ctx, k, value, store.WithTags(tableTags(e.Tables)), store.WithExpiration(localTTL))
+		}
+	} else if invalidatedSince(key.Database, e.Tables, e.ReadAt, e.LSN) {
+		return nil, false, nil
 	}
-	result = &gres
-	return
-}
-
-func Clear() error {
-	return cacheManager.Clear(ctx)
+	return e.Result, time.Now().After(e.FreshUntil), nil
 }
 
-func Set(q string, result *types.QueryResult) (err error) {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	if err := enc.Encode(result); err != nil {
-		return err
+// Set caches result of a query according to its policy, tables are the
+// tables that result depends on, startedAt is when the query was sent to the
+// server and lsn is the WAL location that the server had replayed by then
+// (math.MaxUint64 for the master). Results that were read before the last
+// invalidation of any of the tables, or from a replica that has not replayed
+// it yet, are not cached.
+func Set(key *Key, result *types.QueryResult, policy Policy, tables []types.TableInfo, startedAt time.Time, lsn uint64) (err error) {
+	if !policy.Enabled || invalidatedSince(key.Database, tables, startedAt, lsn) {
+		return nil
+	}
+	value := encodeEntry(&entry{
+		Result:     result,
+		FreshUntil: time.Now().Add(policy.TTL),
+		ReadAt:     startedAt,
+		LSN:        lsn,
+		Tables:     tables,
+	})
+	if policy.MaxResultSize > 0 && len(value) > policy.MaxResultSize {
+		return nil
+	}
+	k := key.String()
+	tags := store.WithTags(tableTags(tables))
+	ttl := policy.TTL + staleWhileRevalidate
+	if localCache != nil {
+		localTTL := localTTL
+		if ttl < localTTL {
+			localTTL = ttl
+		}
+		_ = localCache.Set(ctx, k, value, tags, store.WithExpiration(localTTL))
 	}
-	err = cacheManager.Set(ctx, []byte(q), buf.Bytes())
-	return
+	return cacheManager.Set(ctx, k, value, tags, store.WithExpiration(ttl))
 }
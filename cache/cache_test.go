@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	_ "github.com/mhkarimi1383/pg_pro/config/configtest"
+	"github.com/mhkarimi1383/pg_pro/types"
+)
+
+// entries have to be checked against invalidations when they are read, tags
+// of the backend could miss them
+func TestGetInvalidated(t *testing.T) {
+	users := types.TableInfo{Schema: "public", Name: "users"}
+	policy := Policy{Enabled: true, TTL: time.Minute}
+	tests := []struct {
+		name     string
+		database string
+		// read is when the query was sent to the server (relative to now)
+		read       time.Duration
+		lsn        uint64
+		invalidate func(database string)
+		hit        bool
+	}{
+		{name: "not invalidated", database: "fresh", lsn: math.MaxUint64, invalidate: func(string) {}, hit: true},
+		{
+			name:       "table invalidated",
+			database:   "table",
+			lsn:        math.MaxUint64,
+			invalidate: func(string) { invalidateLocally([]types.TableInfo{users}, 0) },
+		},
+		{
+			name:       "database invalidated",
+			database:   "database",
+			lsn:        math.MaxUint64,
+			invalidate: func(database string) { invalidateDatabaseLocally(database, 0) },
+		},
+		{
+			name:     "replica behind the write",
+			database: "replica",
+			read:     time.Hour,
+			lsn:      10,
+			invalidate: func(database string) {
+				invalidateDatabaseLocally(database, 20)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := &Key{Query: "SELECT * FROM users", Database: tt.database}
+			result := &types.QueryResult{CommandTag: []byte("SELECT 0")}
+			if err := Set(key, result, policy, []types.TableInfo{users}, time.Now().Add(tt.read), tt.lsn); err != nil {
+				t.Fatal(err)
+			}
+			tt.invalidate(tt.database)
+			got, _, err := Get(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got != nil) != tt.hit {
+				t.Fatalf("hit = %v, want %v", got != nil, tt.hit)
+			}
+		})
+	}
+}
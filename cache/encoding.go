@@ -0,0 +1,190 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/pkg/errors"
+
+	"github.com/mhkarimi1383/pg_pro/config"
+	"github.com/mhkarimi1383/pg_pro/types"
+)
+
+// Cached entries are stored as
+//
+//	version (1 byte) | compression (1 byte) | payload
+//
+// and payload (compressed as a whole) is
+//
+//	fresh until (int64 unix nanoseconds) | read at (int64 unix nanoseconds) |
+//	lsn (uint64) | tables count (uint16) |
+//	(schema, name as null terminated strings)... |
+//	RowDescription | DataRow... | CommandComplete
+//
+// tables are the dependencies of the result, read at and lsn tell when and
+// from where it was read (entries are checked against invalidations when they
+// are read, since tags of most backends are not updated atomically), messages are in the postgres wire format, so the format does not
+// depend on the struct layout of pgproto3. Entries of other versions are
+// treated as misses, so the version has to be bumped on every change.
+const formatVersion byte = 3
+
+type compression byte
+
+const (
+	noCompression compression = iota
+	snappyCompression
+)
+
+var (
+	compressionAlgorithms = map[string]compression{
+		"":       noCompression,
+		"none":   noCompression,
+		"snappy": snappyCompression,
+	}
+	entryCompression, compressionConfigured = compressionAlgorithms[config.GetString("cache.compression.algorithm")]
+	// compressionThreshold is the minimum size of payloads (in bytes) to be
+	// compressed
+	compressionThreshold = config.GetInt("cache.compression.threshold")
+
+	errUnknownFormat = errors.New("unknown cache entry format")
+)
+
+func init() {
+	if !compressionConfigured {
+		panic("invalid cache compression algorithm")
+	}
+}
+
+// entry is what is stored in the cache backend, entries are kept for the
+// stale-while-revalidate window after they are expired
+type entry struct {
+	Result     *types.QueryResult
+	FreshUntil time.Time
+	// ReadAt is when the query was sent to the server and LSN is the WAL
+	// location that the server had replayed by then (see Set)
+	ReadAt time.Time
+	LSN    uint64
+	Tables []types.TableInfo
+}
+
+func encodeEntry(e *entry) []byte {
+	payload := make([]byte, 24, 1024)
+	binary.BigEndian.PutUint64(payload, uint64(e.FreshUntil.UnixNano()))
+	binary.BigEndian.PutUint64(payload[8:], uint64(e.ReadAt.UnixNano()))
+	binary.BigEndian.PutUint64(payload[16:], e.LSN)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(e.Tables)))
+	for _, table := range e.Tables {
+		payload = append(payload, table.Schema...)
+		payload = append(payload, 0)
+		payload = append(payload, table.Name...)
+		payload = append(payload, 0)
+	}
+	payload = e.Result.RowDescription.Encode(payload)
+	for i := range e.Result.DataRows {
+		payload = e.Result.DataRows[i].Encode(payload)
+	}
+	payload = (&pgproto3.CommandComplete{CommandTag: e.Result.CommandTag}).Encode(payload)
+
+	c := noCompression
+	if entryCompression != noCompression && len(payload) >= compressionThreshold {
+		c = entryCompression
+	}
+	value := []byte{formatVersion, byte(c)}
+	switch c {
+	case snappyCompression:
+		return append(value, snappy.Encode(nil, payload)...)
+	default:
+		return append(value, payload...)
+	}
+}
+
+// decodeEntry decodes an entry, returned entry references the value
+func decodeEntry(value []byte) (*entry, error) {
+	if len(value) < 2 || value[0] != formatVersion {
+		return nil, errUnknownFormat
+	}
+	payload := value[2:]
+	switch compression(value[1]) {
+	case noCompression:
+	case snappyCompression:
+		var err error
+		if payload, err = snappy.Decode(nil, payload); err != nil {
+			return nil, errors.Wrap(err, "decompressing cache entry")
+		}
+	default:
+		return nil, errUnknownFormat
+	}
+
+	if len(payload) < 26 {
+		return nil, errUnknownFormat
+	}
+	e := &entry{
+		Result:     new(types.QueryResult),
+		FreshUntil: time.Unix(0, int64(binary.BigEndian.Uint64(payload))),
+		ReadAt:     time.Unix(0, int64(binary.BigEndian.Uint64(payload[8:]))),
+		LSN:        binary.BigEndian.Uint64(payload[16:]),
+	}
+	tablesCount := int(binary.BigEndian.Uint16(payload[24:]))
+	payload = payload[26:]
+	for i := 0; i < tablesCount; i++ {
+		var table types.TableInfo
+		var ok bool
+		if table.Schema, payload, ok = cutString(payload); !ok {
+			return nil, errUnknownFormat
+		}
+		if table.Name, payload, ok = cutString(payload); !ok {
+			return nil, errUnknownFormat
+		}
+		e.Tables = append(e.Tables, table)
+	}
+
+	completed := false
+	for len(payload) > 0 {
+		if completed || len(payload) < 5 {
+			return nil, errUnknownFormat
+		}
+		msgType := payload[0]
+		length := int(binary.BigEndian.Uint32(payload[1:]))
+		if length < 4 || len(payload) < 1+length {
+			return nil, errUnknownFormat
+		}
+		body := payload[5 : 1+length]
+		payload = payload[1+length:]
+
+		var err error
+		switch msgType {
+		case 'T':
+			err = e.Result.RowDescription.Decode(body)
+		case 'D':
+			row := pgproto3.DataRow{}
+			err = row.Decode(body)
+			e.Result.DataRows = append(e.Result.DataRows, row)
+		case 'C':
+			completion := pgproto3.CommandComplete{}
+			err = completion.Decode(body)
+			e.Result.CommandTag = completion.CommandTag
+			completed = true
+		default:
+			err = errUnknownFormat
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !completed {
+		return nil, errUnknownFormat
+	}
+	return e, nil
+}
+
+// cutString cuts a null terminated string from the beginning of b
+func cutString(b []byte) (s string, rest []byte, ok bool) {
+	i := bytes.IndexByte(b, 0)
+	if i < 0 {
+		return "", nil, false
+	}
+	return string(b[:i]), b[i+1:], true
+}
@@ -0,0 +1,106 @@
+package cache
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+
+	_ "github.com/mhkarimi1383/pg_pro/config/configtest"
+	"github.com/mhkarimi1383/pg_pro/types"
+)
+
+func testEntry(rows int, tables ...types.TableInfo) *entry {
+	result := &types.QueryResult{
+		RowDescription: pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{
+			{Name: []byte("id"), TableOID: 16384, TableAttributeNumber: 1, DataTypeOID: 23, DataTypeSize: 4, TypeModifier: -1},
+			{Name: []byte("name"), TableOID: 16384, TableAttributeNumber: 2, DataTypeOID: 25, DataTypeSize: -1, TypeModifier: -1},
+		}},
+		CommandTag: []byte("SELECT 0"),
+	}
+	for i := 0; i < rows; i++ {
+		result.DataRows = append(result.DataRows, pgproto3.DataRow{Values: [][]byte{[]byte("1"), []byte("name")}})
+	}
+	return &entry{
+		Result:     result,
+		FreshUntil: time.Unix(1700000000, 123456789),
+		ReadAt:     time.Unix(1699999990, 987654321),
+		LSN:        0x16B374D848,
+		Tables:     tables,
+	}
+}
+
+func TestEncodeEntryRoundTrip(t *testing.T) {
+	withNulls := testEntry(0)
+	withNulls.Result.DataRows = []pgproto3.DataRow{{Values: [][]byte{nil, {}}}}
+	tests := []struct {
+		name        string
+		entry       *entry
+		compression compression
+	}{
+		{name: "no rows", entry: testEntry(0), compression: noCompression},
+		{name: "below compression threshold", entry: testEntry(1, types.TableInfo{Schema: "public", Name: "users"}), compression: noCompression},
+		{name: "compressed", entry: testEntry(100, types.TableInfo{Schema: "public", Name: "users"}, types.TableInfo{Schema: "s", Name: "t"}), compression: snappyCompression},
+		{name: "null and empty values", entry: withNulls, compression: noCompression},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value := encodeEntry(tt.entry)
+			if value[0] != formatVersion || compression(value[1]) != tt.compression {
+				t.Fatalf("header = %v, want version %v and compression %v", value[:2], formatVersion, tt.compression)
+			}
+			decoded, err := decodeEntry(value)
+			if err != nil {
+				t.Fatalf("decoding: %v", err)
+			}
+			if !decoded.FreshUntil.Equal(tt.entry.FreshUntil) || !decoded.ReadAt.Equal(tt.entry.ReadAt) {
+				t.Fatalf("fresh until = %v and read at = %v, want %v and %v", decoded.FreshUntil, decoded.ReadAt, tt.entry.FreshUntil, tt.entry.ReadAt)
+			}
+			decoded.FreshUntil = tt.entry.FreshUntil
+			decoded.ReadAt = tt.entry.ReadAt
+			if !reflect.DeepEqual(decoded, tt.entry) {
+				t.Fatalf("decoded = %+v, want %+v", decoded, tt.entry)
+			}
+		})
+	}
+}
+
+func TestDecodeEntryCorrupt(t *testing.T) {
+	valid := encodeEntry(testEntry(1, types.TableInfo{Schema: "public", Name: "users"}))
+	compressed := encodeEntry(testEntry(100))
+	withoutCompletion := valid[:len(valid)-len("SELECT 0")-6]
+	withTrailing := append(append([]byte(nil), valid...), 'C', 0, 0, 0, 4)
+	unknownMessage := append([]byte(nil), valid...)
+	unknownMessage[len(unknownMessage)-len("SELECT 0")-6] = 'Z'
+	badLength := append([]byte(nil), valid...)
+	badLength[len(badLength)-len("SELECT 0")-5] = 0xff
+	badCompression := append([]byte(nil), valid...)
+	badCompression[1] = 0xff
+	corruptCompressed := append([]byte(nil), compressed...)
+	corruptCompressed[2] ^= 0xff
+
+	tests := []struct {
+		name  string
+		value []byte
+	}{
+		{name: "empty", value: nil},
+		{name: "only header", value: []byte{formatVersion, byte(noCompression)}},
+		{name: "other version", value: append([]byte{formatVersion + 1}, valid[1:]...)},
+		{name: "unknown compression", value: badCompression},
+		{name: "corrupt compressed payload", value: corruptCompressed},
+		{name: "truncated tables", value: valid[:30]},
+		{name: "truncated message", value: valid[:len(valid)-1]},
+		{name: "missing completion", value: withoutCompletion},
+		{name: "message after completion", value: withTrailing},
+		{name: "unknown message", value: unknownMessage},
+		{name: "message length out of range", value: badLength},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if e, err := decodeEntry(tt.value); err == nil {
+				t.Fatalf("decoded corrupt entry: %+v", e)
+			}
+		})
+	}
+}
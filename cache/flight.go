@@ -0,0 +1,52 @@
+package cache
+
+import (
+	"sync"
+
+	"github.com/mhkarimi1383/pg_pro/types"
+)
+
+var (
+	flightsLock sync.Mutex
+	flights     = map[string]*Flight{}
+)
+
+// Flight is a single execution of a query, concurrent cache misses of the same
+// key wait for its result instead of running the query themselves
+type Flight struct {
+	key    string
+	done   chan struct{}
+	result *types.QueryResult
+}
+
+// JoinFlight returns the running flight of the key, or starts a new one when
+// there is none, leader is true for the caller that has to run the query and
+// call Finish
+func JoinFlight(key *Key) (f *Flight, leader bool) {
+	k := key.String()
+	flightsLock.Lock()
+	defer flightsLock.Unlock()
+	if f, ok := flights[k]; ok {
+		return f, false
+	}
+	f = &Flight{key: k, done: make(chan struct{})}
+	flights[k] = f
+	return f, true
+}
+
+// Finish publishes the result to waiting callers, result is nil when the
+// query has failed (or its result could not be shared)
+func (f *Flight) Finish(result *types.QueryResult) {
+	flightsLock.Lock()
+	delete(flights, f.key)
+	flightsLock.Unlock()
+	f.result = result
+	close(f.done)
+}
+
+// Wait waits for the leader and returns its result, nil means the caller has
+// to run the query itself
+func (f *Flight) Wait() *types.QueryResult {
+	<-f.done
+	return f.result
+}
@@ -0,0 +1,127 @@
+package cache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/eko/gocache/lib/v4/store"
+	"go.uber.org/zap"
+
+	"github.com/mhkarimi1383/pg_pro/logger"
+	"github.com/mhkarimi1383/pg_pro/types"
+)
+
+// invalidation is the last invalidation of a table (or a whole database),
+// results of reads that were running concurrently with the write (started
+// before at) or that were read from replicas that have not replayed the write
+// yet (replayed less than lsn) are not cached
+type invalidation struct {
+	at time.Time
+	// lsn is the WAL location of the master after the write, 0 when it is
+	// unknown
+	lsn uint64
+}
+
+var (
+	invalidationsLock     sync.Mutex
+	invalidations         = map[types.TableInfo]invalidation{}
+	databaseInvalidations = map[string]invalidation{}
+)
+
+// record updates an invalidation, LSN of the latest write is kept even when
+// invalidations are received out of order (e.g. from other instances)
+func (i *invalidation) record(lsn uint64) {
+	i.at = time.Now()
+	if lsn > i.lsn {
+		i.lsn = lsn
+	}
+}
+
+// stale tells if a result that was read starting at t from a server that had
+// replayed lsn could miss the invalidated write
+func (i invalidation) stale(t time.Time, lsn uint64) bool {
+	return i.at.After(t) || i.lsn > lsn
+}
+
+// tableTags converts tables to cache tags, every cached entry is tagged with
+// the tables it depends on
+func tableTags(tables []types.TableInfo) []string {
+	tags := make([]string, 0, len(tables))
+	for _, table := range tables {
+		tags = append(tags, "table:"+table.Schema+"."+table.Name)
+	}
+	return tags
+}
+
+// Invalidate removes every cached entry that depends on any of the tables,
+// lsn is the WAL location of the master after they were written
+func Invalidate(tables []types.TableInfo, lsn uint64) error {
+	if len(tables) == 0 {
+		return nil
+	}
+	invalidateLocally(tables, lsn)
+	publish(&invalidationEvent{Tables: tables, LSN: lsn})
+	return cacheManager.Invalidate(ctx, store.WithInvalidateTags(tableTags(tables)))
+}
+
+// invalidateLocally records invalidation of the tables and removes entries of
+// the local cache that depend on them
+func invalidateLocally(tables []types.TableInfo, lsn uint64) {
+	invalidationsLock.Lock()
+	for _, table := range tables {
+		i := invalidations[table]
+		i.record(lsn)
+		invalidations[table] = i
+	}
+	invalidationsLock.Unlock()
+
+	if localCache == nil {
+		return
+	}
+	if err := localCache.Invalidate(ctx, store.WithInvalidateTags(tableTags(tables))); err != nil {
+		logger.Warn(err.Error(), zap.String("event", "cache_invalidate"))
+	}
+}
+
+// InvalidateDatabase invalidates every cached entry of a database, entries are
+// not tagged with their database (tags of most backends would grow without
+// bound), they are treated as misses by Get and replaced by later reads
+func InvalidateDatabase(database string, lsn uint64) {
+	invalidateDatabaseLocally(database, lsn)
+	publish(&invalidationEvent{Database: database, LSN: lsn})
+}
+
+func invalidateDatabaseLocally(database string, lsn uint64) {
+	invalidationsLock.Lock()
+	defer invalidationsLock.Unlock()
+	i := databaseInvalidations[database]
+	i.record(lsn)
+	databaseInvalidations[database] = i
+}
+
+// clearLocally drops the local cache, it is used when invalidation events of
+// other instances could have been missed
+func clearLocally() {
+	if localCache == nil {
+		return
+	}
+	if err := localCache.Clear(ctx); err != nil {
+		logger.Warn(err.Error(), zap.String("event", "cache_invalidate"))
+	}
+}
+
+// invalidatedSince tells if result of a read that started at t on a server
+// that had replayed lsn could miss any invalidated write
+func invalidatedSince(database string, tables []types.TableInfo, t time.Time, lsn uint64) bool {
+	invalidationsLock.Lock()
+	defer invalidationsLock.Unlock()
+	if databaseInvalidations[database].stale(t, lsn) {
+		return true
+	}
+	for _, table := range tables {
+		if invalidations[table].stale(t, lsn) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+)
+
+// Key identifies a cached result, everything that could change the result
+// of a query has to be part of it
+type Key struct {
+	// Query is the normalized query
+	Query            string
+	ParameterOIDs    []uint32
+	ParameterFormats []int16
+	Parameters       [][]byte
+	ResultFormats    []int16
+	Database         string
+	// Scope limits sharing of the result between users (see ScopeFor)
+	Scope string
+	// Settings are the session variables changed by the client (e.g.
+	// search_path), in a stable order
+	Settings []string
+}
+
+// String returns a fixed length hash of the key
+func (k *Key) String() string {
+	h := sha256.New()
+	writeString := func(s string) {
+		_ = binary.Write(h, binary.BigEndian, int32(len(s)))
+		h.Write([]byte(s))
+	}
+	writeString(k.Query)
+	_ = binary.Write(h, binary.BigEndian, int32(len(k.ParameterOIDs)))
+	_ = binary.Write(h, binary.BigEndian, k.ParameterOIDs)
+	parameterFormats := normalizeFormats(k.ParameterFormats)
+	_ = binary.Write(h, binary.BigEndian, int32(len(parameterFormats)))
+	_ = binary.Write(h, binary.BigEndian, parameterFormats)
+	_ = binary.Write(h, binary.BigEndian, int32(len(k.Parameters)))
+	for _, p := range k.Parameters {
+		if p == nil {
+			// NULL differs from an empty value
+			_ = binary.Write(h, binary.BigEndian, int32(-1))
+			continue
+		}
+		writeString(string(p))
+	}
+	resultFormats := normalizeFormats(k.ResultFormats)
+	_ = binary.Write(h, binary.BigEndian, int32(len(resultFormats)))
+	_ = binary.Write(h, binary.BigEndian, resultFormats)
+	writeString(k.Database)
+	writeString(k.Scope)
+	_ = binary.Write(h, binary.BigEndian, int32(len(k.Settings)))
+	for _, s := range k.Settings {
+		writeString(s)
+	}
+	return "pg_pro:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// normalizeFormats treats all-text format codes the same as no format codes
+func normalizeFormats(formats []int16) []int16 {
+	for _, f := range formats {
+		if f != 0 {
+			return formats
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package cache
+
+import (
+	"strings"
+	"testing"
+
+	_ "github.com/mhkarimi1383/pg_pro/config/configtest"
+)
+
+func TestKeyString(t *testing.T) {
+	base := Key{
+		Query:      "SELECT * FROM users WHERE id = $1",
+		Parameters: [][]byte{[]byte("1")},
+		Database:   "postgres",
+		Scope:      "user:user_1",
+		Settings:   []string{"SET search_path TO public"},
+	}
+	tests := []struct {
+		name  string
+		key   Key
+		equal bool
+	}{
+		{name: "same key", key: base, equal: true},
+		{name: "text format codes", key: func() Key {
+			k := base
+			k.ParameterFormats = []int16{0}
+			k.ResultFormats = []int16{0, 0}
+			return k
+		}(), equal: true},
+		{name: "binary results", key: func() Key { k := base; k.ResultFormats = []int16{1}; return k }(), equal: false},
+		{name: "other parameter", key: func() Key { k := base; k.Parameters = [][]byte{[]byte("2")}; return k }(), equal: false},
+		{name: "null parameter", key: func() Key { k := base; k.Parameters = [][]byte{nil}; return k }(), equal: false},
+		{name: "parameter types", key: func() Key { k := base; k.ParameterOIDs = []uint32{23}; return k }(), equal: false},
+		{name: "other database", key: func() Key { k := base; k.Database = "app"; return k }(), equal: false},
+		{name: "other scope", key: func() Key { k := base; k.Scope = "user:user_2"; return k }(), equal: false},
+		{name: "no settings", key: func() Key { k := base; k.Settings = nil; return k }(), equal: false},
+		{name: "shifted boundaries", key: func() Key {
+			k := base
+			k.Database = "post"
+			k.Scope = "gres" + base.Scope
+			return k
+		}(), equal: false},
+	}
+	want := base.String()
+	if !strings.HasPrefix(want, "pg_pro:") || len(want) != len("pg_pro:")+64 {
+		t.Fatalf("unexpected key format %q", want)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.key.String(); (got == want) != tt.equal {
+				t.Fatalf("key = %v, base = %v, want equal %v", got, want, tt.equal)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package cache
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mhkarimi1383/pg_pro/config"
+	"github.com/mhkarimi1383/pg_pro/types"
+)
+
+// Policy controls if and how long results of a query are cached
+type Policy struct {
+	Enabled bool
+	TTL     time.Duration
+	// MaxResultSize is the maximum size of a cached result in bytes, 0 means
+	// no limit
+	MaxResultSize int
+}
+
+// policyRule is an entry of `cache.policies`, empty matchers match
+// everything and unset settings are not changed
+type policyRule struct {
+	// Tables are globs matching `schema.table` (or only the table name when
+	// there is no dot in the pattern)
+	Tables        []string `mapstructure:"tables"`
+	Users         []string `mapstructure:"users"`
+	Fingerprints  []string `mapstructure:"fingerprints"`
+	Enabled       *bool    `mapstructure:"enabled"`
+	TTL           *int64   `mapstructure:"ttl"`
+	MaxResultSize *int     `mapstructure:"max_result_size"`
+}
+
+var (
+	defaultPolicy = Policy{
+		Enabled:       true,
+		TTL:           config.GetDuration("cache.ttl") * time.Second,
+		MaxResultSize: config.GetInt("cache.max_result_size"),
+	}
+	// policyRules are loaded before init, backends are created using them
+	policyRules = loadPolicyRules()
+)
+
+func loadPolicyRules() (rules []policyRule) {
+	if err := config.UnmarshalKey("cache.policies", &rules); err != nil {
+		panic(errors.Wrap(err, "parsing cache policies"))
+	}
+	for _, rule := range rules {
+		for _, pattern := range rule.Tables {
+			if _, err := path.Match(pattern, ""); err != nil {
+				panic(errors.Wrapf(err, "invalid cache policy table pattern %q", pattern))
+			}
+		}
+	}
+	return
+}
+
+// maxPolicyTTL returns the longest TTL of the configured policies
+func maxPolicyTTL() time.Duration {
+	ttl := defaultPolicy.TTL
+	for _, rule := range policyRules {
+		if rule.TTL != nil && time.Duration(*rule.TTL)*time.Second > ttl {
+			ttl = time.Duration(*rule.TTL) * time.Second
+		}
+	}
+	return ttl
+}
+
+// PolicyFor returns the cache policy of a query, every matching rule is
+// applied and the strictest settings win (disabled, the shortest TTL and the
+// smallest size limit)
+func PolicyFor(tables []types.TableInfo, username, fingerprint string) Policy {
+	policy := defaultPolicy
+	ttlSet := false
+	for _, rule := range policyRules {
+		if !rule.matches(tables, username, fingerprint) {
+			continue
+		}
+		if rule.Enabled != nil && !*rule.Enabled {
+			policy.Enabled = false
+		}
+		if rule.TTL != nil && *rule.TTL > 0 {
+			ttl := time.Duration(*rule.TTL) * time.Second
+			if !ttlSet || ttl < policy.TTL {
+				policy.TTL = ttl
+				ttlSet = true
+			}
+		}
+		if rule.MaxResultSize != nil && *rule.MaxResultSize > 0 &&
+			(policy.MaxResultSize == 0 || *rule.MaxResultSize < policy.MaxResultSize) {
+			policy.MaxResultSize = *rule.MaxResultSize
+		}
+	}
+	return policy
+}
+
+// HasFingerprintPolicies tells if any policy matches queries by their
+// fingerprint, fingerprints are not needed otherwise
+func HasFingerprintPolicies() bool {
+	for _, rule := range policyRules {
+		if len(rule.Fingerprints) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *policyRule) matches(tables []types.TableInfo, username, fingerprint string) bool {
+	if len(r.Users) > 0 && !contains(r.Users, username) {
+		return false
+	}
+	if len(r.Fingerprints) > 0 && !contains(r.Fingerprints, fingerprint) {
+		return false
+	}
+	if len(r.Tables) == 0 {
+		return true
+	}
+	for _, table := range tables {
+		for _, pattern := range r.Tables {
+			name := table.Schema + "." + table.Name
+			if !strings.Contains(pattern, ".") {
+				name = table.Name
+			}
+			if matched, _ := path.Match(pattern, name); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, i := range list {
+		if i == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	_ "github.com/mhkarimi1383/pg_pro/config/configtest"
+	"github.com/mhkarimi1383/pg_pro/types"
+)
+
+// policies are configured in config/testdata/config.yaml
+func TestPolicyFor(t *testing.T) {
+	countries := types.TableInfo{Schema: "public", Name: "countries"}
+	currencies := types.TableInfo{Schema: "reference", Name: "currencies"}
+	orders := types.TableInfo{Schema: "sales", Name: "orders"}
+	users := types.TableInfo{Schema: "public", Name: "users"}
+	tests := []struct {
+		name        string
+		tables      []types.TableInfo
+		username    string
+		fingerprint string
+		want        Policy
+	}{
+		{name: "default", tables: []types.TableInfo{users}, username: "user_1", want: Policy{Enabled: true, TTL: 10 * time.Second, MaxResultSize: 1048576}},
+		{name: "qualified table", tables: []types.TableInfo{countries}, username: "user_1", want: Policy{Enabled: true, TTL: time.Hour, MaxResultSize: 1048576}},
+		{name: "schema glob", tables: []types.TableInfo{users, currencies}, username: "user_1", want: Policy{Enabled: true, TTL: time.Hour, MaxResultSize: 1048576}},
+		{name: "unqualified pattern", tables: []types.TableInfo{countries, orders}, username: "user_1", want: Policy{Enabled: false, TTL: time.Hour, MaxResultSize: 1048576}},
+		{name: "user", tables: []types.TableInfo{users}, username: "analytics", want: Policy{Enabled: true, TTL: time.Minute, MaxResultSize: 1024}},
+		{name: "shortest ttl wins", tables: []types.TableInfo{countries}, username: "analytics", want: Policy{Enabled: true, TTL: time.Minute, MaxResultSize: 1024}},
+		{name: "fingerprint", tables: []types.TableInfo{countries}, username: "analytics", fingerprint: "50fde20626009aba", want: Policy{Enabled: true, TTL: 5 * time.Second, MaxResultSize: 1024}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := PolicyFor(tt.tables, tt.username, tt.fingerprint); got != tt.want {
+				t.Fatalf("policy = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+	if !HasFingerprintPolicies() {
+		t.Fatal("fingerprint policy is not detected")
+	}
+}
+
+// policies are configured in config/testdata/config.yaml
+func TestMaxPolicyTTL(t *testing.T) {
+	if got, want := maxPolicyTTL(), time.Hour; got != want {
+		t.Fatalf("max TTL = %v, want %v", got, want)
+	}
+}
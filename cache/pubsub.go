@@ -0,0 +1,99 @@
+package cache
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+
+	"github.com/mhkarimi1383/pg_pro/config"
+	"github.com/mhkarimi1383/pg_pro/logger"
+	"github.com/mhkarimi1383/pg_pro/types"
+)
+
+// invalidationEvent is published to other pg_pro instances, so they could
+// invalidate their local caches
+type invalidationEvent struct {
+	Instance string            `json:"instance"`
+	Tables   []types.TableInfo `json:"tables,omitempty"`
+	Database string            `json:"database,omitempty"`
+	LSN      uint64            `json:"lsn,omitempty"`
+}
+
+var (
+	pubsubClient  *redis.Client
+	pubsubChannel string
+	// instanceID is used for ignoring our own events
+	instanceID string
+)
+
+// startPubSub subscribes to invalidation events of other instances, it is a
+// no-op when `cache.l1.pubsub` is not configured
+func startPubSub() {
+	if config.Get("cache.l1.pubsub") == nil {
+		return
+	}
+	pubsubClient = redis.NewClient(&redis.Options{
+		Addr:     config.GetString("cache.l1.pubsub.addr"),
+		Password: config.GetString("cache.l1.pubsub.password"),
+		DB:       config.GetInt("cache.l1.pubsub.db"),
+	})
+	pubsubChannel = config.GetString("cache.l1.pubsub.channel")
+	if pubsubChannel == "" {
+		pubsubChannel = "pg_pro:invalidations"
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	instanceID = hex.EncodeToString(id)
+
+	go subscribe(pubsubClient.Subscribe(ctx, pubsubChannel))
+}
+
+func subscribe(sub *redis.PubSub) {
+	for msg := range sub.ChannelWithSubscriptions() {
+		switch msg := msg.(type) {
+		case *redis.Subscription:
+			// events could be missed while we were not subscribed
+			logger.Info(
+				"subscribed to invalidation events",
+				zap.String("event", "cache_pubsub"),
+			)
+			clearLocally()
+		case *redis.Message:
+			event := invalidationEvent{}
+			if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+				logger.Warn(err.Error(), zap.String("event", "cache_pubsub"))
+				clearLocally()
+				continue
+			}
+			if event.Instance == instanceID {
+				continue
+			}
+			if event.Database != "" {
+				invalidateDatabaseLocally(event.Database, event.LSN)
+			} else {
+				invalidateLocally(event.Tables, event.LSN)
+			}
+		}
+	}
+}
+
+// publish sends an invalidation event to other instances
+func publish(event *invalidationEvent) {
+	if pubsubClient == nil {
+		return
+	}
+	event.Instance = instanceID
+	payload, err := json.Marshal(event)
+	if err != nil {
+		logger.Warn(err.Error(), zap.String("event", "cache_pubsub"))
+		return
+	}
+	if err := pubsubClient.Publish(ctx, pubsubChannel, payload).Err(); err != nil {
+		logger.Warn(err.Error(), zap.String("event", "cache_pubsub"))
+	}
+}
@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/mhkarimi1383/pg_pro/config"
+	"github.com/mhkarimi1383/pg_pro/types"
+)
+
+type scopeMode string
+
+const (
+	// sharedScope shares cached results between all users
+	sharedScope scopeMode = "shared"
+	// userScope keeps cached results of every user separate
+	userScope scopeMode = "user"
+	// groupScope shares cached results between users of the same group
+	groupScope scopeMode = "group"
+)
+
+var (
+	scope      = scopeMode(config.GetString("cache.scope.mode"))
+	userGroups = map[string]string{}
+
+	rowSecurityLock sync.RWMutex
+	// rowSecurityTables are tables with row level security enabled, results
+	// depending on them are never shared, nil means they are not known yet
+	rowSecurityTables map[types.TableInfo]bool
+)
+
+func init() {
+	switch scope {
+	case "":
+		scope = userScope
+	case sharedScope, userScope, groupScope:
+	default:
+		panic("invalid cache scope mode")
+	}
+
+	groups := map[string][]string{}
+	if err := config.UnmarshalKey("cache.scope.groups", &groups); err != nil {
+		panic(errors.Wrap(err, "parsing cache scope groups"))
+	}
+	for group, users := range groups {
+		for _, user := range users {
+			userGroups[user] = group
+		}
+	}
+}
+
+// SetRowSecurityTables sets tables that have row level security enabled
+func SetRowSecurityTables(tables []types.TableInfo) {
+	rowSecurity := make(map[types.TableInfo]bool, len(tables))
+	for _, table := range tables {
+		rowSecurity[table] = true
+	}
+	rowSecurityLock.Lock()
+	defer rowSecurityLock.Unlock()
+	rowSecurityTables = rowSecurity
+}
+
+func usesRowSecurity(tables []types.TableInfo) bool {
+	rowSecurityLock.RLock()
+	defer rowSecurityLock.RUnlock()
+	if rowSecurityTables == nil {
+		return true
+	}
+	for _, table := range tables {
+		if rowSecurityTables[table] {
+			return true
+		}
+	}
+	return false
+}
+
+// ScopeFor returns scope of cached results of a user, results are only shared
+// between users with the same scope
+func ScopeFor(username string, tables []types.TableInfo) string {
+	mode := scope
+	if mode != userScope && usesRowSecurity(tables) {
+		mode = userScope
+	}
+	switch mode {
+	case sharedScope:
+		return ""
+	case groupScope:
+		if group, ok := userGroups[username]; ok {
+			return "group:" + group
+		}
+	}
+	return "user:" + username
+}
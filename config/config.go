@@ -1,17 +1,27 @@
 package config
 
 import (
+	"os"
+	"strings"
 	"time"
 
 	"github.com/spf13/viper"
 )
 
 func init() {
-	viper.SetConfigName("config")
 	viper.SetConfigType("yaml")
-	viper.AddConfigPath("/etc/pg_pro/")
-	viper.AddConfigPath("$HOME/.pg_pro")
-	viper.AddConfigPath(".")
+	// keys could be overridden by environment variables (e.g. `PG_PRO_AUTH_PATH` for `auth.path`)
+	viper.SetEnvPrefix("pg_pro")
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	viper.AutomaticEnv()
+	if path := os.Getenv("PG_PRO_CONFIG"); path != "" {
+		viper.SetConfigFile(path)
+	} else {
+		viper.SetConfigName("config")
+		viper.AddConfigPath("/etc/pg_pro/")
+		viper.AddConfigPath("$HOME/.pg_pro")
+		viper.AddConfigPath(".")
+	}
 	err := viper.ReadInConfig()
 	if err != nil {
 		panic(err)
@@ -27,7 +37,7 @@ func GetSlice(key string) []any {
 }
 
 func GetStringSlice(key string) []string {
-	return viper.Get(key).([]string)
+	return viper.GetStringSlice(key)
 }
 
 func GetUint(key string) uint {
@@ -57,3 +67,15 @@ func GetInt64(key string) int64 {
 func GetDuration(key string) time.Duration {
 	return viper.GetDuration(key)
 }
+
+func GetBool(key string) bool {
+	return viper.GetBool(key)
+}
+
+func GetStringMapString(key string) map[string]string {
+	return viper.GetStringMapString(key)
+}
+
+func UnmarshalKey(key string, rawVal any) error {
+	return viper.UnmarshalKey(key, rawVal)
+}
@@ -0,0 +1,18 @@
+// Package configtest points the config of tests to config/testdata, it has to be imported
+// (as `_`) by tests of packages reading the config during their initialization.
+//
+// It only depends on the standard library, so it is initialized before the config is read.
+package configtest
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+func init() {
+	_, file, _, _ := runtime.Caller(0)
+	testdata := filepath.Join(filepath.Dir(file), "..", "testdata")
+	os.Setenv("PG_PRO_CONFIG", filepath.Join(testdata, "config.yaml"))
+	os.Setenv("PG_PRO_AUTH_PATH", filepath.Join(testdata, "users.yaml"))
+}
@@ -0,0 +1,238 @@
+package connection
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+
+	"github.com/mhkarimi1383/pg_pro/config"
+)
+
+// cluster is a group of sources serving a logical database, the top level
+// `sources` form the default cluster that serves `database` (and every
+// database that is not listed in `databases` when `catch_all` is enabled)
+type cluster struct {
+	name    string
+	sources []*source
+	// users maps client users to backend credentials, clients without a
+	// mapping use credentials of the source urls
+	users map[string]*backendUser
+
+	poolsLock sync.RWMutex
+	masters   []*source
+	replicas  []replica
+
+	parametersLock    sync.RWMutex
+	parameterStatuses map[string]string
+}
+
+// backendUser is the user that pg_pro connects to sources with on behalf of
+// clients, every backend user has its own pool on every source
+type backendUser struct {
+	User     string `mapstructure:"user"`
+	Password string `mapstructure:"password"`
+	MinConns int32  `mapstructure:"min_conns"`
+	MaxConns int32  `mapstructure:"max_conns"`
+}
+
+// internalPoolSize is the maximum number of connections that pg_pro uses for
+// its own queries on every source
+const internalPoolSize = 4
+
+type databaseConfig struct {
+	Sources []map[string]any        `mapstructure:"sources"`
+	Users   map[string]*backendUser `mapstructure:"users"`
+}
+
+var (
+	// defaultCluster is nil when there is no top level `sources`
+	defaultCluster *cluster
+	// catchAll routes unknown databases to the default cluster
+	catchAll = config.GetBool("catch_all")
+	// clusters are keyed by database names, names of users and databases
+	// are lower case in the config like every other key
+	clusters = map[string]*cluster{}
+)
+
+// loadClusters creates pools of every configured source
+func loadClusters() {
+	if sources, ok := config.Get("sources").([]any); ok && len(sources) > 0 {
+		defaultCluster = &cluster{name: strings.ToLower(config.GetString("database"))}
+		for _, src := range sources {
+			defaultCluster.sources = append(defaultCluster.sources, newSource(src.(map[string]any)))
+		}
+	}
+
+	databases := map[string]databaseConfig{}
+	if err := config.UnmarshalKey("databases", &databases); err != nil {
+		panic(errors.Wrap(err, "parsing databases"))
+	}
+	for name, database := range databases {
+		if len(database.Sources) == 0 {
+			panic(fmt.Sprintf("database %v has no sources", name))
+		}
+		c := &cluster{name: name, users: database.Users}
+		for _, src := range database.Sources {
+			c.sources = append(c.sources, newSource(src))
+		}
+		clusters[name] = c
+	}
+
+	if defaultCluster == nil && len(clusters) == 0 {
+		panic("no sources provided")
+	}
+}
+
+func newSource(src map[string]any) *source {
+	cfg, err := pgxpool.ParseConfig(fmt.Sprintf("%v", src["url"]))
+	if err != nil {
+		panic(errors.Wrap(err, "pgxpool config parse"))
+	}
+
+	minConns, err := strconv.Atoi(fmt.Sprintf("%v", src["min_conns"]))
+	if err != nil {
+		panic(errors.Wrap(err, "converting min_conns to number"))
+	}
+	cfg.MinConns = int32(minConns)
+	maxConns, err := strconv.Atoi(fmt.Sprintf("%v", src["max_conns"]))
+	if err != nil {
+		panic(errors.Wrap(err, "converting max_conns to number"))
+	}
+	cfg.MaxConns = int32(maxConns)
+	if tlsSettings, ok := src["tls"].(map[string]any); ok {
+		cfg.ConnConfig.TLSConfig, err = sourceTLSConfig(tlsSettings, cfg.ConnConfig.Host)
+		if err != nil {
+			panic(errors.Wrap(err, "source tls config"))
+		}
+		// settings of the `tls` section take precedence over `sslmode` of the url
+		cfg.ConnConfig.Fallbacks = nil
+	}
+	pool, err := pgxpool.NewWithConfig(context.Background(), cfg)
+	if err != nil {
+		panic(errors.Wrap(err, "creating pool"))
+	}
+	internalConfig := cfg.Copy()
+	internalConfig.MinConns = 0
+	internalConfig.MaxConns = internalPoolSize
+	internal, err := pgxpool.NewWithConfig(context.Background(), internalConfig)
+	if err != nil {
+		panic(errors.Wrap(err, "creating internal pool"))
+	}
+	return &source{
+		name:      fmt.Sprintf("%v:%v/%v", cfg.ConnConfig.Host, cfg.ConnConfig.Port, cfg.ConnConfig.Database),
+		config:    cfg,
+		pool:      pool,
+		internal:  internal,
+		userPools: map[string]*pgxpool.Pool{},
+		role:      roleFromMode(fmt.Sprintf("%v", src["mode"])),
+		healthy:   true,
+	}
+}
+
+// allClusters returns every cluster, the default one comes first
+func allClusters() []*cluster {
+	result := make([]*cluster, 0, len(clusters)+1)
+	if defaultCluster != nil {
+		result = append(result, defaultCluster)
+	}
+	names := make([]string, 0, len(clusters))
+	for name := range clusters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		result = append(result, clusters[name])
+	}
+	return result
+}
+
+// poolFor returns the pool of a backend user, pools of backend users other
+// than the one of the url are created on first use
+func (src *source) poolFor(user *backendUser) (*pgxpool.Pool, error) {
+	if user == nil {
+		return src.pool, nil
+	}
+	src.userPoolsLock.Lock()
+	defer src.userPoolsLock.Unlock()
+	if pool, ok := src.userPools[user.User]; ok {
+		return pool, nil
+	}
+	cfg := src.config.Copy()
+	cfg.ConnConfig.User = user.User
+	cfg.ConnConfig.Password = user.Password
+	if user.MaxConns > 0 {
+		cfg.MaxConns = user.MaxConns
+	}
+	cfg.MinConns = user.MinConns
+	pool, err := pgxpool.NewWithConfig(context.Background(), cfg)
+	if err != nil {
+		return nil, errors.Wrapf(err, "creating pool of %v on %v", user.User, src.name)
+	}
+	src.userPools[user.User] = pool
+	return pool, nil
+}
+
+// internalPool returns the pool of pg_pro itself on the master
+func (c *cluster) internalPool() (*pgxpool.Pool, error) {
+	src, _, err := c.pickSource(false, ReadRequirements{})
+	if err != nil {
+		return nil, err
+	}
+	return src.internal, nil
+}
+
+// Route tells where queries of a client go, the cluster serving its
+// database and the backend user of its connections
+type Route struct {
+	cluster *cluster
+	user    *backendUser
+	// username and database are names of the client as they are used in
+	// the config
+	username string
+	database string
+}
+
+// RouteFor returns the route of a client asking for a database, names are
+// matched case insensitively since config keys are lower case
+func RouteFor(database, username string) (Route, error) {
+	database, username = strings.ToLower(database), strings.ToLower(username)
+	c, ok := clusters[database]
+	if !ok && defaultCluster != nil && (catchAll || database == defaultCluster.name) {
+		c = defaultCluster
+	}
+	if c == nil {
+		return Route{}, &pgconn.PgError{
+			Severity: "FATAL",
+			Code:     "3D000", // invalid_catalog_name
+			Message:  fmt.Sprintf("database %q does not exist", database),
+		}
+	}
+	return Route{cluster: c, user: c.users[username], username: username, database: database}, nil
+}
+
+// Database returns name of the database serving the client, cached results
+// are kept per database
+func (r Route) Database() string {
+	return r.cluster.name
+}
+
+// pickPool selects one of the replicas for read operations (if there is any
+// replica matching the requirements) and the master for everything else
+func (r Route) pickPool(readOperation bool, req ReadRequirements) (pool *pgxpool.Pool, lsn uint64, err error) {
+	if r.cluster == nil {
+		return nil, 0, errNoMaster
+	}
+	src, lsn, err := r.cluster.pickSource(readOperation, req)
+	if err != nil {
+		return nil, 0, err
+	}
+	pool, err = src.poolFor(r.user)
+	return pool, lsn, err
+}
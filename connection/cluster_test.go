@@ -0,0 +1,36 @@
+package connection
+
+import (
+	"testing"
+
+	_ "github.com/mhkarimi1383/pg_pro/config/configtest"
+)
+
+// sources are configured in config/testdata/config.yaml
+func TestRouteFor(t *testing.T) {
+	tests := []struct {
+		database string
+		wantErr  bool
+	}{
+		{database: "postgres"},
+		{database: "Postgres"},
+		{database: "other", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.database, func(t *testing.T) {
+			route, err := RouteFor(tt.database, "User_1")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if route.Database() != "postgres" || route.username != "user_1" {
+				t.Fatalf("route = %v for %v, want postgres for user_1", route.Database(), route.username)
+			}
+			if route.PoolMode() != SessionPoolMode {
+				t.Fatalf("pool mode = %v, want %v", route.PoolMode(), SessionPoolMode)
+			}
+		})
+	}
+}
@@ -2,142 +2,114 @@ package connection
 
 import (
 	"context"
-	"fmt"
+	"math"
 	"math/rand"
-	"net"
-	"strconv"
+	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
-	"github.com/jackc/pgx/v5/pgproto3"
 	"github.com/jackc/pgx/v5/pgxpool"
-	"github.com/pkg/errors"
-	"go.uber.org/zap"
-
-	"github.com/mhkarimi1383/pg_pro/cache"
-	"github.com/mhkarimi1383/pg_pro/config"
-	"github.com/mhkarimi1383/pg_pro/logger"
-	"github.com/mhkarimi1383/pg_pro/types"
-	"github.com/mhkarimi1383/pg_pro/utils"
 )
 
-var (
-	writePools []*pgxpool.Pool
-	readPools  []*pgxpool.Pool
-)
+var errNoMaster = &pgconn.PgError{
+	Severity: "FATAL",
+	Code:     "57P03", // cannot_connect_now
+	Message:  "no master is available right now",
+}
 
 func init() {
-	for _, source := range config.GetSlice("sources") {
-		src := source.(map[string]any)
-		cfg, err := pgxpool.ParseConfig(fmt.Sprintf("%v", src["url"]))
-		if err != nil {
-			panic(errors.Wrap(err, "pgxpool config parse"))
-		}
-
-		minConns, err := strconv.Atoi(fmt.Sprintf("%v", src["min_conns"]))
-		if err != nil {
-			panic(errors.Wrap(err, "converting min_conns to number"))
-		}
-		cfg.MinConns = int32(minConns)
-		maxConns, err := strconv.Atoi(fmt.Sprintf("%v", src["max_conns"]))
-		if err != nil {
-			panic(errors.Wrap(err, "converting max_conns to number"))
+	loadClusters()
+	for _, c := range allClusters() {
+		if healthCheckInterval > 0 {
+			c.checkSources()
 		}
-		cfg.MaxConns = int32(maxConns)
-		pool, err := pgxpool.NewWithConfig(context.Background(), cfg)
-		if err == nil {
-			if src["mode"] == "slave" {
-				readPools = append(readPools, pool)
-			} else if src["mode"] == "master" {
-				writePools = append(writePools, pool)
-			}
+		c.rebuildPools(true)
+		// TODO: Add support for mutiple write destinations (e.g. for data-warehousing and data-lake)
+		if healthCheckInterval == 0 && len(c.masters) > 1 {
+			panic("multiple write connections provided")
 		}
+		go loadParameterStatuses(c)
 	}
-	// TODO: Add support for mutiple write destinations (e.g. for data-warehousing and data-lake)
-	if len(writePools) > 1 {
-		panic("multiple write connections provided")
+	if healthCheckInterval > 0 {
+		go healthChecker()
 	}
+	startInvalidation()
+	go loadRowSecurityTables()
 }
 
-func RunQuery(q string, readOperation bool, args ...any) (result *types.QueryResult, err error) {
-	fromCache := false
-	defer func() {
-		if err == nil && readOperation && !fromCache {
-			cacheSetErr := cache.Set(q, result)
-			if cacheSetErr != nil {
-				logger.Warn(cacheSetErr.Error(), zap.String("event", "cache_set"))
-			}
-		}
-	}()
-	result = new(types.QueryResult)
+// ReadRequirements limits replicas that could serve a read operation
+type ReadRequirements struct {
+	// MaxLag is the tolerated replication lag, 0 means no limit
+	MaxLag time.Duration
+	// MinLSN is the LSN that replica must have replayed (used for
+	// read-your-writes), 0 means any replica is fine
+	MinLSN uint64
+}
+
+// pickSource selects one of the replicas for read operations (if there is
+// any replica matching the requirements) and the master for everything else,
+// lsn is the WAL location that the source is known to have replayed
+// (math.MaxUint64 for the master)
+func (c *cluster) pickSource(readOperation bool, req ReadRequirements) (src *source, lsn uint64, err error) {
+	c.poolsLock.RLock()
+	defer c.poolsLock.RUnlock()
 	if readOperation {
-		cacheResult, err := cache.Get(q)
-		if err == nil && cacheResult != nil {
-			result = cacheResult
-			fromCache = true
-			return result, nil
+		candidates := make([]replica, 0, len(c.replicas))
+		for _, r := range c.replicas {
+			if (req.MaxLag <= 0 || r.lag <= req.MaxLag) && r.lsn >= req.MinLSN {
+				candidates = append(candidates, r)
+			}
 		}
-		if err != nil {
-			logger.Warn(errors.Wrap(err, "error while reading cached data, using postgresql itself").Error(), zap.String("event", "cache_read"))
-			err = nil
+		if len(candidates) > 0 {
+			r := candidates[rand.Intn(len(candidates))]
+			return r.src, r.lsn, nil
 		}
 	}
-	var pool *pgxpool.Pool
-	if readOperation && len(readPools) > 0 {
-		pool = readPools[rand.Intn(len(readPools))]
-	} else {
-		pool = writePools[rand.Intn(len(writePools))]
+	if len(c.masters) == 0 {
+		return nil, 0, errNoMaster
 	}
-	rows, err := pool.Query(context.TODO(), q, args...)
+	return c.masters[rand.Intn(len(c.masters))], math.MaxUint64, nil
+}
+
+// Acquire gets a dedicated connection for relaying wire protocol messages,
+// caller have to release it after the server became ready for query again
+func Acquire(ctx context.Context, route Route, readOperation bool) (*pgxpool.Conn, error) {
+	pool, _, err := route.pickPool(readOperation, ReadRequirements{MaxLag: maxReplicaLag})
 	if err != nil {
-		return
+		return nil, err
 	}
-	defer rows.Close()
+	return pool.Acquire(ctx)
+}
 
-	for _, desc := range rows.FieldDescriptions() {
-		result.RowDescription.Fields = append(result.RowDescription.Fields, pgproto3.FieldDescription{
-			Name:                 []byte(desc.Name),
-			Format:               desc.Format,
-			TypeModifier:         desc.TypeModifier,
-			DataTypeSize:         desc.DataTypeSize,
-			DataTypeOID:          desc.DataTypeOID,
-			TableOID:             desc.TableOID,
-			TableAttributeNumber: desc.TableAttributeNumber,
-		})
-	}
-	for rows.Next() {
-		// rows.RawValues() is not working (for example some numberic datas will get broken)
-		values, rowValuesErr := rows.Values()
-		if rowValuesErr != nil {
-			return nil, rowValuesErr
-		}
-		dataRow := pgproto3.DataRow{}
-		for _, value := range values {
-			byteValue := utils.GetBytes(value)
-			dataRow.Values = append(dataRow.Values, byteValue)
-		}
-		result.DataRows = append(result.DataRows, dataRow)
-	}
-	rows.Close()
-	if rows.Err() != nil {
-		return result, rows.Err()
+// AcquireReplica gets a connection for a read operation from a replica
+// matching the requirements, or from the master if there is none, lsn is the
+// WAL location that the server is known to have replayed (math.MaxUint64 for
+// the master)
+func AcquireReplica(ctx context.Context, route Route, req ReadRequirements) (conn *pgxpool.Conn, lsn uint64, err error) {
+	pool, lsn, err := route.pickPool(true, req)
+	if err != nil {
+		return nil, 0, err
 	}
-	result.CommandTag = []byte(rows.CommandTag().String())
-	return
+	conn, err = pool.Acquire(ctx)
+	return conn, lsn, err
 }
 
-func RunExecute(q string, params ...any) (tag pgconn.CommandTag, err error) {
-	pool := writePools[rand.Intn(len(writePools))]
-	tag, err = pool.Exec(context.Background(), q, params...)
+// CurrentLSN returns the current WAL write location of the master of the
+// route
+func CurrentLSN(ctx context.Context, route Route) (uint64, error) {
+	pool, err := route.cluster.internalPool()
 	if err != nil {
-		return
+		return 0, err
 	}
-	return
+	return currentLSN(ctx, pool)
 }
 
-func GetRawConnection() (net.Conn, error) {
-	conn, err := writePools[rand.Intn(len(writePools))].Acquire(context.Background())
-	if err != nil {
-		return nil, err
+func currentLSN(ctx context.Context, conn interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}) (uint64, error) {
+	var lsn string
+	if err := conn.QueryRow(ctx, "SELECT pg_current_wal_lsn()::text").Scan(&lsn); err != nil {
+		return 0, err
 	}
-	return conn.Conn().PgConn().Conn(), nil
+	return ParseLSN(lsn)
 }
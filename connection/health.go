@@ -0,0 +1,248 @@
+package connection
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/mhkarimi1383/pg_pro/config"
+	"github.com/mhkarimi1383/pg_pro/logger"
+)
+
+type role string
+
+const (
+	unknownRole role = "unknown"
+	masterRole  role = "master"
+	replicaRole role = "slave"
+)
+
+// source is one of the configured servers, role, health and replication
+// status are updated by the health checker
+type source struct {
+	name   string
+	config *pgxpool.Config
+	// pool uses credentials of the url, it is used by clients without
+	// backend credentials
+	pool *pgxpool.Pool
+	// internal is used by queries of pg_pro itself (health checks, LSNs,
+	// ...), connections of clients are reset using `pooling.reset_query`
+	// which drops statements cached by pgx, so they are only used for
+	// relaying messages
+	internal      *pgxpool.Pool
+	userPoolsLock sync.Mutex
+	userPools     map[string]*pgxpool.Pool
+	role          role
+	newRole       role
+	healthy       bool
+	lag           time.Duration
+	lsn           uint64
+}
+
+// replica is a snapshot of a healthy replica used for read routing
+type replica struct {
+	name string
+	src  *source
+	lag  time.Duration
+	lsn  uint64
+}
+
+// unknownLag is the lag of replicas that are behind the master but have not
+// replayed any transaction yet
+const unknownLag = time.Duration(math.MaxInt64)
+
+var (
+	healthCheckInterval = config.GetDuration("health_check.interval") * time.Second
+	healthCheckTimeout  = config.GetDuration("health_check.timeout") * time.Second
+)
+
+func roleFromMode(mode string) role {
+	switch role(mode) {
+	case masterRole, replicaRole:
+		return role(mode)
+	default:
+		return unknownRole
+	}
+}
+
+func healthChecker() {
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, c := range allClusters() {
+			changed := c.checkSources()
+			// lag of replicas changes all the time, so pools are always rebuilt
+			c.rebuildPools(changed)
+		}
+	}
+}
+
+// checkSources asks every source about its role, it returns true when
+// anything has changed since the last check. Masters are checked first, so
+// replicas are not considered behind WAL written after they were checked
+func (c *cluster) checkSources() (changed bool) {
+	sources := make([]*source, 0, len(c.sources))
+	for _, src := range c.sources {
+		if src.role == masterRole {
+			sources = append(sources, src)
+		}
+	}
+	for _, src := range c.sources {
+		if src.role != masterRole {
+			sources = append(sources, src)
+		}
+	}
+	for _, src := range sources {
+		err := checkSource(src)
+		healthy := err == nil
+		if healthy != src.healthy {
+			changed = true
+			if healthy {
+				logger.Info(
+					"source is reachable again",
+					zap.String("event", "health_check"),
+					zap.String("source", src.name),
+				)
+			} else {
+				logger.Warn(
+					err.Error(),
+					zap.String("event", "health_check"),
+					zap.String("source", src.name),
+				)
+			}
+			src.healthy = healthy
+		}
+		if healthy && src.newRole != src.role {
+			changed = true
+			logger.Warn(
+				"source role changed",
+				zap.String("event", "role_transition"),
+				zap.String("source", src.name),
+				zap.String("from", string(src.role)),
+				zap.String("to", string(src.newRole)),
+			)
+			src.role = src.newRole
+		}
+	}
+	return
+}
+
+// sourceStatusQuery returns role, time since the last replayed transaction
+// (null for masters or when nothing is replayed yet) and the last replayed (or
+// written for masters) LSN of a source. Replayed timestamp grows while the
+// master is idle, so it is only used as lag of replicas behind the LSN of the
+// master (see rebuildPools)
+const sourceStatusQuery = `SELECT
+	pg_is_in_recovery(),
+	CASE WHEN pg_is_in_recovery() THEN EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()) END::float8,
+	(CASE WHEN pg_is_in_recovery() THEN pg_last_wal_replay_lsn() ELSE pg_current_wal_lsn() END)::text`
+
+func checkSource(src *source) error {
+	timeout := healthCheckTimeout
+	if timeout == 0 {
+		timeout = healthCheckInterval
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var (
+		inRecovery bool
+		lagSeconds *float64
+		lsn        *string
+	)
+	if err := src.internal.QueryRow(ctx, sourceStatusQuery).Scan(&inRecovery, &lagSeconds, &lsn); err != nil {
+		return err
+	}
+	if lsn != nil {
+		parsed, err := ParseLSN(*lsn)
+		if err != nil {
+			return err
+		}
+		src.lsn = parsed
+	}
+	src.lag = unknownLag
+	if lagSeconds != nil {
+		src.lag = time.Duration(*lagSeconds * float64(time.Second))
+	} else if !inRecovery {
+		src.lag = 0
+	}
+	if inRecovery {
+		src.newRole = replicaRole
+	} else {
+		src.newRole = masterRole
+	}
+	return nil
+}
+
+// ParseLSN converts textual representation of a `pg_lsn` (e.g. `16/B374D848`)
+// to a number
+func ParseLSN(s string) (uint64, error) {
+	var hi, lo uint32
+	if _, err := fmt.Sscanf(s, "%X/%X", &hi, &lo); err != nil {
+		return 0, errors.Wrapf(err, "parsing lsn %q", s)
+	}
+	return uint64(hi)<<32 | uint64(lo), nil
+}
+
+// rebuildPools puts healthy sources into read and write pools based on their
+// current role, warnings are only logged when roles or health have changed.
+// Replicas that have replayed the LSN of the master have no lag, others
+// (including the ones that are disconnected from the master) lag behind it by
+// the time since their last replayed transaction
+func (c *cluster) rebuildPools(changed bool) {
+	var writes []*source
+	var replicas []*source
+	for _, src := range c.sources {
+		if !src.healthy {
+			continue
+		}
+		switch src.role {
+		case masterRole:
+			writes = append(writes, src)
+		case replicaRole:
+			replicas = append(replicas, src)
+		}
+	}
+	reads := make([]replica, 0, len(replicas))
+	for _, src := range replicas {
+		lag := src.lag
+		if len(writes) > 0 && src.lsn >= writes[0].lsn {
+			lag = 0
+		}
+		reads = append(reads, replica{
+			src:  src,
+			lag:  lag,
+			lsn:  src.lsn,
+			name: src.name,
+		})
+	}
+	if len(writes) > 1 && changed {
+		logger.Warn(
+			"more than one master detected, using only the first one",
+			zap.String("event", "role_transition"),
+			zap.String("database", c.name),
+			zap.Int("masters", len(writes)),
+		)
+	}
+	if len(writes) > 1 {
+		writes = writes[:1]
+	}
+	if len(writes) == 0 && changed {
+		logger.Warn(
+			"no master is available",
+			zap.String("event", "role_transition"),
+			zap.String("database", c.name),
+		)
+	}
+
+	c.poolsLock.Lock()
+	defer c.poolsLock.Unlock()
+	c.masters = writes
+	c.replicas = reads
+}
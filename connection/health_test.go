@@ -0,0 +1,34 @@
+package connection
+
+import (
+	"testing"
+
+	_ "github.com/mhkarimi1383/pg_pro/config/configtest"
+)
+
+func TestParseLSN(t *testing.T) {
+	tests := []struct {
+		lsn     string
+		want    uint64
+		wantErr bool
+	}{
+		{lsn: "0/0", want: 0},
+		{lsn: "16/B374D848", want: 0x16B374D848},
+		{lsn: "16/b374d848", want: 0x16B374D848},
+		{lsn: "FFFFFFFF/FFFFFFFF", want: 1<<64 - 1},
+		{lsn: "", wantErr: true},
+		{lsn: "16", wantErr: true},
+		{lsn: "G/0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.lsn, func(t *testing.T) {
+			got, err := ParseLSN(tt.lsn)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("lsn = %X, want %X", got, tt.want)
+			}
+		})
+	}
+}
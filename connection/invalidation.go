@@ -0,0 +1,338 @@
+package connection
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/mhkarimi1383/pg_pro/cache"
+	"github.com/mhkarimi1383/pg_pro/config"
+	"github.com/mhkarimi1383/pg_pro/logger"
+	"github.com/mhkarimi1383/pg_pro/types"
+)
+
+// Writes that are not going through pg_pro are detected by subscribing to
+// the master, either by `LISTEN`ing to a channel that is notified by triggers
+// or by streaming changes from a logical replication slot (pgoutput)
+
+type invalidationMode string
+
+const (
+	disabledInvalidation invalidationMode = ""
+	notifyInvalidation   invalidationMode = "notify"
+	logicalInvalidation  invalidationMode = "logical"
+
+	invalidationRetryInterval = 5 * time.Second
+)
+
+var (
+	// pgEpoch is the epoch used by replication protocol timestamps
+	pgEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	invalidationChannel     = config.GetString("invalidation.channel")
+	invalidationPublication = config.GetString("invalidation.publication")
+	invalidationSlot        = config.GetString("invalidation.slot")
+)
+
+// startInvalidation starts the configured invalidation subscriber of every
+// cluster in background, it keeps reconnecting (to the current master) on
+// failures
+func startInvalidation() {
+	var subscribe func(ctx context.Context, pool *pgxpool.Pool, database, slot string) error
+	switch invalidationMode(config.GetString("invalidation.mode")) {
+	case disabledInvalidation:
+		return
+	case notifyInvalidation:
+		if invalidationChannel == "" {
+			invalidationChannel = "pg_pro_invalidation"
+		}
+		subscribe = listenNotifications
+	case logicalInvalidation:
+		if invalidationPublication == "" {
+			invalidationPublication = "pg_pro"
+		}
+		if invalidationSlot == "" {
+			invalidationSlot = fmt.Sprintf("pg_pro_%d_%d", os.Getpid(), time.Now().Unix())
+		}
+		subscribe = streamChanges
+	default:
+		panic("invalid invalidation mode")
+	}
+
+	for i, c := range allClusters() {
+		slot := invalidationSlot
+		if i > 0 {
+			slot = fmt.Sprintf("%v_%d", invalidationSlot, i)
+		}
+		go func(c *cluster, slot string) {
+			ctx := context.Background()
+			for {
+				pool, err := c.internalPool()
+				if err == nil {
+					err = subscribe(ctx, pool, c.name, slot)
+				}
+				logger.Warn(
+					err.Error(),
+					zap.String("event", "cache_invalidation"),
+					zap.String("database", c.name),
+				)
+				time.Sleep(invalidationRetryInterval)
+			}
+		}(c, slot)
+	}
+}
+
+// subscribed is called whenever a subscription is (re)established, changes
+// made while we were not subscribed are unknown so every cached result of the
+// database is dropped, lsn is the WAL location of the master when the
+// subscription started
+func subscribed(database string, lsn uint64) {
+	logger.Info(
+		"subscribed to changes of the master",
+		zap.String("event", "cache_invalidation"),
+		zap.String("database", database),
+	)
+	cache.InvalidateDatabase(database, lsn)
+}
+
+func invalidate(tables []types.TableInfo, lsn uint64) {
+	if err := cache.Invalidate(tables, lsn); err != nil {
+		logger.Warn(err.Error(), zap.String("event", "cache_invalidation"))
+	}
+}
+
+// listenNotifications waits for notifications with `schema.table` (or only
+// the table name) as payload, empty payload drops every cached result of the
+// database
+func listenNotifications(ctx context.Context, pool *pgxpool.Pool, database, _ string) error {
+	poolConn, err := pool.Acquire(ctx)
+	if err != nil {
+		return errors.Wrap(err, "acquiring connection for LISTEN")
+	}
+	// connection would be left in LISTEN state, so it is not given back to the pool
+	conn := poolConn.Hijack()
+	defer conn.Close(ctx)
+
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{invalidationChannel}.Sanitize()); err != nil {
+		return errors.Wrap(err, "listening to invalidation channel")
+	}
+	lsn, err := currentLSN(ctx, conn)
+	if err != nil {
+		return errors.Wrap(err, "getting LSN of the master")
+	}
+	subscribed(database, lsn)
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return errors.Wrap(err, "waiting for notifications")
+		}
+		// notifications are delivered after the commit, so the current LSN
+		// is after the write
+		lsn, err := currentLSN(ctx, conn)
+		if err != nil {
+			return errors.Wrap(err, "getting LSN of the master")
+		}
+		if notification.Payload == "" {
+			cache.InvalidateDatabase(database, lsn)
+			continue
+		}
+		table := types.TableInfo{Name: notification.Payload}
+		if schema, name, ok := strings.Cut(notification.Payload, "."); ok {
+			table = types.TableInfo{Schema: schema, Name: name}
+		}
+		table.Schema = types.SchemaNameFixer(table.Schema)
+		invalidate([]types.TableInfo{table}, lsn)
+	}
+}
+
+// streamChanges creates a temporary logical replication slot and invalidates
+// tables changed by every committed transaction
+func streamChanges(ctx context.Context, pool *pgxpool.Pool, database, slotName string) error {
+	cfg := pool.Config().ConnConfig.Config.Copy()
+	cfg.RuntimeParams["replication"] = "database"
+	conn, err := pgconn.ConnectConfig(ctx, cfg)
+	if err != nil {
+		return errors.Wrap(err, "connecting for logical replication")
+	}
+	defer conn.Close(ctx)
+
+	slot := pgx.Identifier{slotName}.Sanitize()
+	results, err := conn.Exec(ctx, "CREATE_REPLICATION_SLOT "+slot+" TEMPORARY LOGICAL pgoutput").ReadAll()
+	if err != nil {
+		return errors.Wrap(err, "creating replication slot")
+	}
+	// changes after consistent_point are streamed
+	if len(results) == 0 || len(results[0].Rows) == 0 || len(results[0].Rows[0]) < 2 {
+		return errors.New("unexpected result of CREATE_REPLICATION_SLOT")
+	}
+	consistentPoint, err := ParseLSN(string(results[0].Rows[0][1]))
+	if err != nil {
+		return err
+	}
+
+	conn.Frontend().Send(&pgproto3.Query{String: fmt.Sprintf(
+		"START_REPLICATION SLOT %v LOGICAL 0/0 (proto_version '1', publication_names '%v')",
+		slot,
+		strings.ReplaceAll(invalidationPublication, "'", "''"),
+	)})
+	if err := conn.Frontend().Flush(); err != nil {
+		return errors.Wrap(err, "starting replication")
+	}
+	for started := false; !started; {
+		msg, err := conn.ReceiveMessage(ctx)
+		if err != nil {
+			return errors.Wrap(err, "starting replication")
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.CopyBothResponse:
+			started = true
+		case *pgproto3.ErrorResponse:
+			return errors.Wrap(pgconn.ErrorResponseToPgError(msg), "starting replication")
+		}
+	}
+	subscribed(database, consistentPoint)
+
+	stream := &changeStream{relations: map[uint32]types.TableInfo{}}
+	for {
+		msg, err := conn.ReceiveMessage(ctx)
+		if err != nil {
+			return errors.Wrap(err, "receiving changes")
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.CopyData:
+			if err := stream.handle(conn, msg.Data); err != nil {
+				return err
+			}
+		case *pgproto3.ErrorResponse:
+			return pgconn.ErrorResponseToPgError(msg)
+		case *pgproto3.CopyDone:
+			return errors.New("replication stream ended")
+		}
+	}
+}
+
+// changeStream keeps state of a pgoutput stream, changed tables of the
+// current transaction are invalidated when it is committed
+type changeStream struct {
+	relations     map[uint32]types.TableInfo
+	changed       map[types.TableInfo]bool
+	inTransaction bool
+	// lsn is the position that is processed completely
+	lsn uint64
+}
+
+func (c *changeStream) handle(conn *pgconn.PgConn, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	switch data[0] {
+	case 'k': // primary keepalive
+		if len(data) < 18 {
+			return errors.New("malformed keepalive message")
+		}
+		if !c.inTransaction {
+			c.lsn = binary.BigEndian.Uint64(data[1:9])
+		}
+		if data[17] == 1 {
+			return c.sendStatus(conn)
+		}
+	case 'w': // XLogData
+		if len(data) < 25 {
+			return errors.New("malformed XLogData message")
+		}
+		return c.decode(data[25:])
+	}
+	return nil
+}
+
+// decode handles a single pgoutput message
+func (c *changeStream) decode(msg []byte) error {
+	if len(msg) == 0 {
+		return nil
+	}
+	switch msg[0] {
+	case 'B':
+		c.inTransaction = true
+		c.changed = map[types.TableInfo]bool{}
+	case 'R':
+		if len(msg) < 5 {
+			return errors.New("malformed relation message")
+		}
+		schema, rest := cString(msg[5:])
+		name, _ := cString(rest)
+		if schema == "" {
+			schema = "pg_catalog"
+		}
+		c.relations[binary.BigEndian.Uint32(msg[1:5])] = types.TableInfo{Schema: schema, Name: name}
+	case 'I', 'U', 'D':
+		if len(msg) < 5 {
+			return errors.New("malformed change message")
+		}
+		c.markChanged(binary.BigEndian.Uint32(msg[1:5]))
+	case 'T':
+		if len(msg) < 6 {
+			return errors.New("malformed truncate message")
+		}
+		count := int(binary.BigEndian.Uint32(msg[1:5]))
+		ids := msg[6:]
+		for i := 0; i < count && len(ids) >= 4*(i+1); i++ {
+			c.markChanged(binary.BigEndian.Uint32(ids[4*i:]))
+		}
+	case 'C':
+		if len(msg) < 18 {
+			return errors.New("malformed commit message")
+		}
+		tables := make([]types.TableInfo, 0, len(c.changed))
+		for table := range c.changed {
+			tables = append(tables, table)
+		}
+		// end LSN of the transaction
+		c.lsn = binary.BigEndian.Uint64(msg[10:18])
+		invalidate(tables, c.lsn)
+		c.inTransaction = false
+		c.changed = nil
+	}
+	return nil
+}
+
+func (c *changeStream) markChanged(relationID uint32) {
+	if table, ok := c.relations[relationID]; ok && c.changed != nil {
+		c.changed[table] = true
+	}
+}
+
+// sendStatus sends a standby status update, so the server could free WAL
+// that we have already processed
+func (c *changeStream) sendStatus(conn *pgconn.PgConn) error {
+	data := make([]byte, 34)
+	data[0] = 'r'
+	binary.BigEndian.PutUint64(data[1:], c.lsn)  // written
+	binary.BigEndian.PutUint64(data[9:], c.lsn)  // flushed
+	binary.BigEndian.PutUint64(data[17:], c.lsn) // applied
+	binary.BigEndian.PutUint64(data[25:], uint64(time.Since(pgEpoch).Microseconds()))
+	conn.Frontend().Send(&pgproto3.CopyData{Data: data})
+	return errors.Wrap(conn.Frontend().Flush(), "sending standby status")
+}
+
+// cString reads a null terminated string
+func cString(b []byte) (string, []byte) {
+	i := 0
+	for i < len(b) && b[i] != 0 {
+		i++
+	}
+	if i == len(b) {
+		return string(b), nil
+	}
+	return string(b[:i]), b[i+1:]
+}
@@ -0,0 +1,125 @@
+package connection
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	_ "github.com/mhkarimi1383/pg_pro/config/configtest"
+	"github.com/mhkarimi1383/pg_pro/types"
+)
+
+// pgoutput messages (protocol version 1), only the fields that are decoded
+// are filled
+
+func beginMessage() []byte {
+	return append([]byte{'B'}, make([]byte, 20)...)
+}
+
+func relationMessage(id uint32, schema, name string) []byte {
+	msg := binary.BigEndian.AppendUint32([]byte{'R'}, id)
+	msg = append(append(msg, schema...), 0)
+	msg = append(append(msg, name...), 0)
+	return append(msg, 'd', 0, 0) // replica identity and no columns
+}
+
+func changeMessage(kind byte, id uint32) []byte {
+	return append(binary.BigEndian.AppendUint32([]byte{kind}, id), 'N', 0, 0)
+}
+
+func truncateMessage(ids ...uint32) []byte {
+	msg := binary.BigEndian.AppendUint32([]byte{'T'}, uint32(len(ids)))
+	msg = append(msg, 0) // options
+	for _, id := range ids {
+		msg = binary.BigEndian.AppendUint32(msg, id)
+	}
+	return msg
+}
+
+func commitMessage(endLSN uint64) []byte {
+	msg := []byte{'C', 0}
+	msg = binary.BigEndian.AppendUint64(msg, endLSN-1) // commit LSN
+	msg = binary.BigEndian.AppendUint64(msg, endLSN)
+	return binary.BigEndian.AppendUint64(msg, 0) // commit timestamp
+}
+
+func TestChangeStreamDecode(t *testing.T) {
+	users := types.TableInfo{Schema: "public", Name: "users"}
+	orders := types.TableInfo{Schema: "sales", Name: "orders"}
+	tests := []struct {
+		name     string
+		messages [][]byte
+		changed  map[types.TableInfo]bool
+		lsn      uint64
+		wantErr  bool
+	}{
+		{
+			name:     "insert",
+			messages: [][]byte{beginMessage(), relationMessage(1, "public", "users"), changeMessage('I', 1)},
+			changed:  map[types.TableInfo]bool{users: true},
+		},
+		{
+			name: "update and delete",
+			messages: [][]byte{
+				relationMessage(1, "public", "users"),
+				relationMessage(2, "sales", "orders"),
+				beginMessage(),
+				changeMessage('U', 1),
+				changeMessage('D', 2),
+			},
+			changed: map[types.TableInfo]bool{users: true, orders: true},
+		},
+		{
+			name:     "relation without schema",
+			messages: [][]byte{beginMessage(), relationMessage(1, "", "pg_class"), changeMessage('I', 1)},
+			changed:  map[types.TableInfo]bool{{Schema: "pg_catalog", Name: "pg_class"}: true},
+		},
+		{
+			name:     "truncate with unknown relation",
+			messages: [][]byte{relationMessage(2, "sales", "orders"), beginMessage(), truncateMessage(2, 3)},
+			changed:  map[types.TableInfo]bool{orders: true},
+		},
+		{
+			name:     "change outside of a transaction",
+			messages: [][]byte{relationMessage(1, "public", "users"), changeMessage('I', 1)},
+		},
+		{
+			name:     "commit",
+			messages: [][]byte{beginMessage(), relationMessage(1, "public", "users"), changeMessage('I', 1), commitMessage(0x16B374D848)},
+			lsn:      0x16B374D848,
+		},
+		{
+			name:     "ignored message",
+			messages: [][]byte{{'O'}, {}},
+		},
+		{name: "malformed relation", messages: [][]byte{{'R', 0}}, wantErr: true},
+		{name: "malformed change", messages: [][]byte{beginMessage(), {'I', 0, 0}}, wantErr: true},
+		{name: "malformed truncate", messages: [][]byte{beginMessage(), {'T', 0, 0, 0, 1}}, wantErr: true},
+		{name: "malformed commit", messages: [][]byte{beginMessage(), commitMessage(1)[:17]}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := &changeStream{relations: map[uint32]types.TableInfo{}}
+			var err error
+			for _, msg := range tt.messages {
+				if err = stream.decode(msg); err != nil {
+					break
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(stream.changed) > 0 || len(tt.changed) > 0 {
+				if !reflect.DeepEqual(stream.changed, tt.changed) {
+					t.Fatalf("changed = %v, want %v", stream.changed, tt.changed)
+				}
+			}
+			if stream.lsn != tt.lsn {
+				t.Fatalf("lsn = %X, want %X", stream.lsn, tt.lsn)
+			}
+		})
+	}
+}
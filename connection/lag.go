@@ -0,0 +1,35 @@
+package connection
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mhkarimi1383/pg_pro/config"
+)
+
+var (
+	// maxReplicaLag is the default replication lag limit of read routing, 0
+	// means no limit
+	maxReplicaLag      = config.GetDuration("replica_lag.max") * time.Second
+	userMaxReplicaLags = map[string]time.Duration{}
+)
+
+func init() {
+	for username, s := range config.GetStringMapString("replica_lag.users") {
+		seconds, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			panic(errors.Wrapf(err, "parsing replica_lag of user %v", username))
+		}
+		userMaxReplicaLags[username] = time.Duration(seconds * float64(time.Second))
+	}
+}
+
+// MaxReplicaLag returns replication lag tolerated by the user of the route
+func (r Route) MaxReplicaLag() time.Duration {
+	if lag, ok := userMaxReplicaLags[r.username]; ok {
+		return lag
+	}
+	return maxReplicaLag
+}
@@ -0,0 +1,92 @@
+package connection
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/mhkarimi1383/pg_pro/logger"
+)
+
+const parametersRetryInterval = 5 * time.Second
+
+// reportedParameters are the parameters postgres reports to clients using
+// ParameterStatus messages
+var reportedParameters = []string{
+	"application_name",
+	"client_encoding",
+	"DateStyle",
+	"default_transaction_read_only",
+	"in_hot_standby",
+	"integer_datetimes",
+	"IntervalStyle",
+	"is_superuser",
+	"scram_iterations",
+	"server_encoding",
+	"server_version",
+	"session_authorization",
+	"standard_conforming_strings",
+	"TimeZone",
+}
+
+// loadParameterStatuses collects parameters reported by the master of a
+// cluster when a connection is established, it retries until the master is
+// reachable
+func loadParameterStatuses(c *cluster) {
+	for {
+		statuses, err := collectParameterStatuses(c)
+		if err == nil {
+			c.parametersLock.Lock()
+			c.parameterStatuses = statuses
+			c.parametersLock.Unlock()
+			logger.Info(
+				"parameters of the master are loaded",
+				zap.String("event", "parameter_status"),
+				zap.String("database", c.name),
+				zap.String("server_version", statuses["server_version"]),
+			)
+			return
+		}
+		logger.Warn(
+			err.Error(),
+			zap.String("event", "parameter_status"),
+			zap.String("database", c.name),
+		)
+		time.Sleep(parametersRetryInterval)
+	}
+}
+
+func collectParameterStatuses(c *cluster) (map[string]string, error) {
+	pool, err := c.internalPool()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := pool.Acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	statuses := map[string]string{}
+	for _, name := range reportedParameters {
+		if value := conn.Conn().PgConn().ParameterStatus(name); value != "" {
+			statuses[name] = value
+		}
+	}
+	return statuses, nil
+}
+
+// ParameterStatuses returns parameters reported by the master of the route,
+// it is empty until the master is reachable
+func ParameterStatuses(route Route) map[string]string {
+	statuses := map[string]string{}
+	if route.cluster == nil {
+		return statuses
+	}
+	route.cluster.parametersLock.RLock()
+	defer route.cluster.parametersLock.RUnlock()
+	for name, value := range route.cluster.parameterStatuses {
+		statuses[name] = value
+	}
+	return statuses
+}
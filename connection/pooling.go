@@ -0,0 +1,75 @@
+package connection
+
+import (
+	"fmt"
+
+	"github.com/mhkarimi1383/pg_pro/config"
+)
+
+// PoolMode tells how long a client keeps a master connection
+type PoolMode string
+
+const (
+	// SessionPoolMode keeps the connection until client disconnects
+	SessionPoolMode PoolMode = "session"
+	// TransactionPoolMode keeps the connection until the transaction ends
+	TransactionPoolMode PoolMode = "transaction"
+	// StatementPoolMode releases the connection after every statement,
+	// transactions spanning multiple statements are not allowed
+	StatementPoolMode PoolMode = "statement"
+)
+
+var (
+	defaultPoolMode   PoolMode
+	userPoolModes     map[string]PoolMode
+	databasePoolModes map[string]PoolMode
+)
+
+func init() {
+	var err error
+	defaultPoolMode, err = parsePoolMode(config.GetString("pooling.mode"))
+	if err != nil {
+		panic(err)
+	}
+	userPoolModes, err = parsePoolModes(config.GetStringMapString("pooling.users"))
+	if err != nil {
+		panic(err)
+	}
+	databasePoolModes, err = parsePoolModes(config.GetStringMapString("pooling.databases"))
+	if err != nil {
+		panic(err)
+	}
+}
+
+func parsePoolMode(s string) (PoolMode, error) {
+	switch mode := PoolMode(s); mode {
+	case "":
+		return SessionPoolMode, nil
+	case SessionPoolMode, TransactionPoolMode, StatementPoolMode:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid pooling mode %q", s)
+	}
+}
+
+func parsePoolModes(modes map[string]string) (result map[string]PoolMode, err error) {
+	result = map[string]PoolMode{}
+	for name, s := range modes {
+		if result[name], err = parsePoolMode(s); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// PoolMode returns pooling mode of the client of the route, user specific
+// mode takes precedence over the database one
+func (r Route) PoolMode() PoolMode {
+	if mode, ok := userPoolModes[r.username]; ok {
+		return mode
+	}
+	if mode, ok := databasePoolModes[r.database]; ok {
+		return mode
+	}
+	return defaultPoolMode
+}
@@ -0,0 +1,74 @@
+package connection
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/mhkarimi1383/pg_pro/cache"
+	"github.com/mhkarimi1383/pg_pro/logger"
+	"github.com/mhkarimi1383/pg_pro/types"
+)
+
+const rowSecurityRetryInterval = 5 * time.Second
+
+const rowSecurityQuery = `SELECT n.nspname, c.relname
+	FROM pg_catalog.pg_class c
+	JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+	WHERE c.relrowsecurity`
+
+// loadRowSecurityTables discovers tables with row level security enabled (in
+// every database), so their cached results are never shared between users,
+// it retries until masters are reachable (results are not shared at all
+// until then)
+func loadRowSecurityTables() {
+	for {
+		tables, err := rowSecurityTables()
+		if err == nil {
+			cache.SetRowSecurityTables(tables)
+			logger.Info(
+				"row level security tables are loaded",
+				zap.String("event", "row_security"),
+				zap.Int("tables", len(tables)),
+			)
+			return
+		}
+		logger.Warn(
+			err.Error(),
+			zap.String("event", "row_security"),
+		)
+		time.Sleep(rowSecurityRetryInterval)
+	}
+}
+
+func rowSecurityTables() (tables []types.TableInfo, err error) {
+	for _, c := range allClusters() {
+		clusterTables, err := clusterRowSecurityTables(c)
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, clusterTables...)
+	}
+	return
+}
+
+func clusterRowSecurityTables(c *cluster) (tables []types.TableInfo, err error) {
+	pool, err := c.internalPool()
+	if err != nil {
+		return
+	}
+	rows, err := pool.Query(context.Background(), rowSecurityQuery)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var table types.TableInfo
+		if err = rows.Scan(&table.Schema, &table.Name); err != nil {
+			return
+		}
+		tables = append(tables, table)
+	}
+	return tables, rows.Err()
+}
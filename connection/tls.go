@@ -0,0 +1,86 @@
+package connection
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// sourceTLSConfig builds TLS settings of connections from pg_pro to a
+// source, nil means TLS is disabled
+func sourceTLSConfig(settings map[string]any, host string) (*tls.Config, error) {
+	get := func(key string) string {
+		if v, ok := settings[key]; ok && v != nil {
+			return fmt.Sprintf("%v", v)
+		}
+		return ""
+	}
+
+	cfg := &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+	}
+	if serverName := get("server_name"); serverName != "" {
+		cfg.ServerName = serverName
+	}
+	if certFile := get("cert_file"); certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, get("key_file"))
+		if err != nil {
+			return nil, errors.Wrap(err, "loading source client certificate")
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if caFile := get("ca_file"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading source CA bundle")
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificate found in %v", caFile)
+		}
+	}
+
+	switch mode := get("mode"); mode {
+	case "disable":
+		return nil, nil
+	case "require":
+		cfg.InsecureSkipVerify = true
+	case "verify-ca":
+		// same as postgres, chain is verified but hostname is not
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyChain(cfg.RootCAs, rawCerts)
+		}
+	case "verify-full", "":
+	default:
+		return nil, errors.Errorf("invalid source tls mode %q", mode)
+	}
+	return cfg, nil
+}
+
+func verifyChain(roots *x509.CertPool, rawCerts [][]byte) error {
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	if len(certs) == 0 {
+		return errors.New("server did not provide a certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
@@ -0,0 +1,80 @@
+package msghelper
+
+import (
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	pg_query "github.com/pganalyze/pg_query_go/v4/parser"
+	"github.com/pkg/errors"
+
+	"github.com/mhkarimi1383/pg_pro/types"
+)
+
+// ErrorResponse converts errors from the query parser or from postgres itself
+// to a message that could be sent to the client
+func ErrorResponse(err error) *pgproto3.ErrorResponse {
+	var pgErr *pgconn.PgError
+	var parseErr *pg_query.Error
+	switch {
+	case errors.As(err, &pgErr):
+		return &pgproto3.ErrorResponse{
+			Severity:         pgErr.Severity,
+			Code:             pgErr.Code,
+			Message:          pgErr.Message,
+			Detail:           pgErr.Detail,
+			Hint:             pgErr.Hint,
+			Position:         pgErr.Position,
+			InternalPosition: pgErr.InternalPosition,
+			InternalQuery:    pgErr.InternalQuery,
+			Where:            pgErr.Where,
+			SchemaName:       pgErr.SchemaName,
+			TableName:        pgErr.TableName,
+			ColumnName:       pgErr.ColumnName,
+			DataTypeName:     pgErr.DataTypeName,
+			ConstraintName:   pgErr.ConstraintName,
+			File:             pgErr.File,
+			Line:             pgErr.Line,
+			Routine:          pgErr.Routine,
+		}
+	case errors.As(err, &parseErr):
+		return &pgproto3.ErrorResponse{
+			Severity: "ERROR",
+			Code:     "42601", // syntax_error
+			Message:  parseErr.Message,
+			Where:    parseErr.Context,
+			Position: int32(parseErr.Cursorpos),
+			File:     parseErr.Filename,
+			Line:     int32(parseErr.Lineno),
+			Routine:  parseErr.Funcname,
+		}
+	default:
+		return &pgproto3.ErrorResponse{
+			Severity: "ERROR",
+			Code:     "XX000", // internal_error
+			Message:  err.Error(),
+		}
+	}
+}
+
+// AccessDenied is returned when the auth provider rejects access to a table,
+// it could be converted using ErrorResponse like any other postgres error
+func AccessDenied(info types.TableAccessInfo) *pgconn.PgError {
+	return &pgconn.PgError{
+		Severity:   "ERROR",
+		Code:       "42501", // insufficient_privilege
+		Message:    fmt.Sprintf("permission denied for %v on %v.%v", info.AccessMode.ToString(), info.Schema, info.Name),
+		SchemaName: info.Schema,
+		TableName:  info.Name,
+	}
+}
+
+// SuperuserRequired is returned for statements that only superusers of
+// pg_pro could run
+func SuperuserRequired(reason string) *pgconn.PgError {
+	return &pgconn.PgError{
+		Severity: "ERROR",
+		Code:     "42501", // insufficient_privilege
+		Message:  "must be superuser to " + reason,
+	}
+}
@@ -1,5 +0,0 @@
-package msghelper
-
-func PrepareAnswer(input []byte) []byte {
-	return input
-}
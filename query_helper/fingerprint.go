@@ -0,0 +1,12 @@
+package queryhelper
+
+import (
+	pg_query "github.com/pganalyze/pg_query_go/v4"
+)
+
+// GetFingerprint returns the pg_query fingerprint of the query, queries that
+// only differ in constants have the same fingerprint (pg_query parses the
+// query again, so it is only computed when needed)
+func GetFingerprint(query *Query) (string, error) {
+	return pg_query.Fingerprint(query.text)
+}
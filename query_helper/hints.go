@@ -0,0 +1,45 @@
+package queryhelper
+
+import (
+	"strings"
+
+	pg_query "github.com/pganalyze/pg_query_go/v4"
+
+	"github.com/mhkarimi1383/pg_pro/types"
+)
+
+const hintPrefix = "pg_pro:"
+
+// GetHints returns every pg_pro hint found in comments of the query
+func GetHints(query *Query) (hints []types.QueryHint, err error) {
+	q := query.text
+	result, err := pg_query.Scan(q)
+	if err != nil {
+		return
+	}
+
+	for _, token := range result.Tokens {
+		if token.Token != pg_query.Token_C_COMMENT && token.Token != pg_query.Token_SQL_COMMENT {
+			continue
+		}
+		comment := q[token.Start:token.End]
+		comment = strings.TrimPrefix(comment, "--")
+		comment = strings.TrimPrefix(comment, "/*")
+		comment = strings.TrimSuffix(comment, "*/")
+		fields := strings.Fields(comment)
+		if len(fields) == 0 || !strings.HasPrefix(fields[0], hintPrefix) {
+			continue
+		}
+
+		hint := types.QueryHint{
+			Name:    strings.TrimPrefix(fields[0], hintPrefix),
+			Options: map[string]string{},
+		}
+		for _, option := range fields[1:] {
+			key, value, _ := strings.Cut(option, "=")
+			hint.Options[key] = value
+		}
+		hints = append(hints, hint)
+	}
+	return
+}
@@ -0,0 +1,11 @@
+package queryhelper
+
+import (
+	pg_query "github.com/pganalyze/pg_query_go/v4"
+)
+
+// NormalizeQuery returns a canonical form of the query (comments, casing and
+// formatting are dropped, constants are kept), mostly used as cache key
+func NormalizeQuery(query *Query) (normalized string, err error) {
+	return pg_query.Deparse(query.tree)
+}
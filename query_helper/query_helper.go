@@ -6,81 +6,116 @@ import (
 	"github.com/mhkarimi1383/pg_pro/types"
 )
 
-// IsReadOperation is used for caching data and master/replica load-balancing
-func IsReadOperation(q string) (isRead bool, err error) {
-	result, err := pg_query.Parse(q)
+// Query is a parsed query, every Get* function inspects the same parse tree
+// so queries are only parsed once
+type Query struct {
+	text string
+	tree *pg_query.ParseResult
+}
+
+// Parse parses the query, returned errors could be sent to the client
+func Parse(q string) (*Query, error) {
+	tree, err := pg_query.Parse(q)
 	if err != nil {
-		return
+		return nil, err
 	}
+	return &Query{text: q, tree: tree}, nil
+}
 
-	isRead = true
-	for _, i := range result.Stmts {
-		selectStmt := i.Stmt.GetSelectStmt()
-		if selectStmt == nil {
-			isRead = false
-			break
-		}
+// GetRelatedTables mostly used for access checking
+func GetRelatedTables(query *Query) (tables []types.TableAccessInfo) {
+	for _, i := range query.tree.Stmts {
+		tables = append(tables, stmtTables(i.Stmt)...)
 	}
 	return
 }
 
-// GetRelatedTables mostly used for access checking
-func GetRelatedTables(q string) (tables []types.TableAccessInfo, err error) {
-	result, err := pg_query.Parse(q)
-	if err != nil {
-		return
+func stmtTables(stmt *pg_query.Node) (tables []types.TableAccessInfo) {
+	if selectStmt := stmt.GetSelectStmt(); selectStmt != nil {
+		for _, from := range selectStmt.GetFromClause() {
+			if from.GetRangeVar() != nil {
+				tables = append(tables, types.TableAccessInfo{
+					TableInfo: types.TableInfo{
+						Name:   from.GetRangeVar().Relname,
+						Schema: types.SchemaNameFixer(from.GetRangeVar().Schemaname),
+					},
+					AccessMode: types.Select,
+				})
+			} else {
+				tables = append(tables, types.TableAccessInfo{
+					AccessMode: types.Select,
+				})
+			}
+		}
+	} else if insertStmt := stmt.GetInsertStmt(); insertStmt != nil {
+		tables = append(tables, types.TableAccessInfo{
+			TableInfo: types.TableInfo{
+				Name:   insertStmt.Relation.Relname,
+				Schema: types.SchemaNameFixer(insertStmt.Relation.Schemaname),
+			},
+			AccessMode: types.Insert,
+		})
+	} else if deleteStmt := stmt.GetDeleteStmt(); deleteStmt != nil {
+		tables = append(tables, types.TableAccessInfo{
+			TableInfo: types.TableInfo{
+				Name:   deleteStmt.Relation.Relname,
+				Schema: types.SchemaNameFixer(deleteStmt.Relation.Schemaname),
+			},
+			AccessMode: types.Delete,
+		})
+	} else if updateStmt := stmt.GetUpdateStmt(); updateStmt != nil {
+		tables = append(tables, types.TableAccessInfo{
+			TableInfo: types.TableInfo{
+				Name:   updateStmt.Relation.Relname,
+				Schema: types.SchemaNameFixer(updateStmt.Relation.Schemaname),
+			},
+			AccessMode: types.Update,
+		})
+	} else if copyStmt := stmt.GetCopyStmt(); copyStmt != nil {
+		tables = append(tables, copyTables(copyStmt)...)
+	} else if sessionStmt(stmt) {
+		// session variables are replayed per client, they are not shared
+	} else {
+		tables = append(tables, types.TableAccessInfo{
+			TableInfo: types.TableInfo{
+				Name:   "",
+				Schema: "",
+			},
+			AccessMode: types.System,
+		})
 	}
+	return
+}
 
-	for _, i := range result.Stmts {
-		if selectStmt := i.Stmt.GetSelectStmt(); selectStmt != nil {
-			for _, from := range selectStmt.GetFromClause() {
-				if from.GetRangeVar() != nil {
-					tables = append(tables, types.TableAccessInfo{
-						TableInfo: types.TableInfo{
-							Name:   from.GetRangeVar().Relname,
-							Schema: types.SchemaNameFixer(from.GetRangeVar().Schemaname),
-						},
-						AccessMode: types.Select,
-					})
-				} else {
-					tables = append(tables, types.TableAccessInfo{
-						AccessMode: types.Select,
-					})
-				}
-			}
-		} else if insertStmt := i.Stmt.GetInsertStmt(); insertStmt != nil {
-			tables = append(tables, types.TableAccessInfo{
-				TableInfo: types.TableInfo{
-					Name:   insertStmt.Relation.Relname,
-					Schema: types.SchemaNameFixer(insertStmt.Relation.Schemaname),
-				},
-				AccessMode: types.Insert,
-			})
-		} else if deleteStmt := i.Stmt.GetDeleteStmt(); deleteStmt != nil {
-			tables = append(tables, types.TableAccessInfo{
-				TableInfo: types.TableInfo{
-					Name:   deleteStmt.Relation.Relname,
-					Schema: types.SchemaNameFixer(deleteStmt.Relation.Schemaname),
-				},
-				AccessMode: types.Delete,
-			})
-		} else if updateStmt := i.Stmt.GetUpdateStmt(); updateStmt != nil {
-			tables = append(tables, types.TableAccessInfo{
-				TableInfo: types.TableInfo{
-					Name:   deleteStmt.Relation.Relname,
-					Schema: types.SchemaNameFixer(updateStmt.Relation.Schemaname),
-				},
-				AccessMode: types.Update,
-			})
-		} else {
-			tables = append(tables, types.TableAccessInfo{
-				TableInfo: types.TableInfo{
-					Name:   "",
-					Schema: "",
-				},
-				AccessMode: types.System,
-			})
+// copyTables classifies `COPY table FROM` as INSERT and `COPY table TO` or
+// `COPY (query) TO` as SELECT, server side files and programs are only
+// allowed for superusers (see QueryTraits.SuperuserOnly)
+func copyTables(copyStmt *pg_query.CopyStmt) (tables []types.TableAccessInfo) {
+	if copyStmt.Relation != nil {
+		accessMode := types.Select
+		if copyStmt.IsFrom {
+			accessMode = types.Insert
 		}
+		tables = append(tables, types.TableAccessInfo{
+			TableInfo: types.TableInfo{
+				Name:   copyStmt.Relation.Relname,
+				Schema: types.SchemaNameFixer(copyStmt.Relation.Schemaname),
+			},
+			AccessMode: accessMode,
+		})
+	}
+	if copyStmt.Query != nil {
+		tables = append(tables, stmtTables(copyStmt.Query)...)
 	}
 	return
 }
+
+// sessionStmt tells if the statement only reads or changes session variables
+// of the client, changing the role is still a SYSTEM access since pg_pro
+// connects with its own user
+func sessionStmt(stmt *pg_query.Node) bool {
+	if setStmt := stmt.GetVariableSetStmt(); setStmt != nil {
+		return setStmt.Name != "role" && setStmt.Name != "session_authorization"
+	}
+	return stmt.GetVariableShowStmt() != nil || stmt.GetDiscardStmt() != nil
+}
@@ -0,0 +1,121 @@
+package queryhelper
+
+import (
+	"fmt"
+	"strings"
+
+	pg_query "github.com/pganalyze/pg_query_go/v4"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/mhkarimi1383/pg_pro/types"
+)
+
+// GetVariableSets returns `SET`, `RESET` and `DISCARD ALL` statements and
+// `set_config()` calls of the query, they change session variables
+// (search_path, role, ...)
+func GetVariableSets(query *Query) (sets []types.VariableSet, err error) {
+	for _, i := range query.tree.Stmts {
+		if i.Stmt.GetSelectStmt() != nil {
+			walk(i.Stmt.ProtoReflect(), func(m proto.Message) {
+				if node, ok := m.(*pg_query.FuncCall); ok {
+					if set, ok := setConfig(node); ok {
+						sets = append(sets, set)
+					}
+				}
+			})
+			continue
+		}
+		if discardStmt := i.Stmt.GetDiscardStmt(); discardStmt != nil {
+			if discardStmt.Target == pg_query.DiscardMode_DISCARD_ALL {
+				sets = append(sets, types.VariableSet{ResetAll: true})
+			}
+			continue
+		}
+		setStmt := i.Stmt.GetVariableSetStmt()
+		if setStmt == nil {
+			continue
+		}
+		set := types.VariableSet{
+			Name:  setStmt.Name,
+			Local: setStmt.IsLocal,
+		}
+		switch setStmt.Kind {
+		case pg_query.VariableSetKind_VAR_SET_MULTI:
+			// SET TRANSACTION ... only affects the current transaction
+			continue
+		case pg_query.VariableSetKind_VAR_RESET_ALL:
+			set.ResetAll = true
+		case pg_query.VariableSetKind_VAR_RESET, pg_query.VariableSetKind_VAR_SET_DEFAULT:
+			set.Reset = true
+		}
+		set.Statement, err = pg_query.Deparse(&pg_query.ParseResult{Stmts: []*pg_query.RawStmt{i}})
+		if err != nil {
+			return
+		}
+		sets = append(sets, set)
+	}
+	return
+}
+
+// GetPrepares returns `PREPARE`, `DEALLOCATE` and `DISCARD ALL` statements of
+// the query, they change prepared statements of the session
+func GetPrepares(query *Query) (prepares []types.Prepare, err error) {
+	for _, i := range query.tree.Stmts {
+		if discardStmt := i.Stmt.GetDiscardStmt(); discardStmt != nil {
+			if discardStmt.Target == pg_query.DiscardMode_DISCARD_ALL {
+				prepares = append(prepares, types.Prepare{DeallocateAll: true})
+			}
+		} else if deallocateStmt := i.Stmt.GetDeallocateStmt(); deallocateStmt != nil {
+			prepares = append(prepares, types.Prepare{
+				Name:          deallocateStmt.Name,
+				Deallocate:    deallocateStmt.Name != "",
+				DeallocateAll: deallocateStmt.Name == "",
+			})
+		} else if prepareStmt := i.Stmt.GetPrepareStmt(); prepareStmt != nil {
+			prepare := types.Prepare{Name: prepareStmt.Name}
+			prepare.Statement, err = pg_query.Deparse(&pg_query.ParseResult{Stmts: []*pg_query.RawStmt{i}})
+			if err != nil {
+				return
+			}
+			prepares = append(prepares, prepare)
+		}
+	}
+	return
+}
+
+// setConfig converts a `set_config(name, value, is_local)` call to the
+// variable it sets, ok is false for other calls and for arguments that are
+// not constants
+func setConfig(call *pg_query.FuncCall) (set types.VariableSet, ok bool) {
+	name, qualifiedName := functionName(call.Funcname)
+	if name != "set_config" || (qualifiedName != name && qualifiedName != "pg_catalog.set_config") || len(call.Args) != 3 {
+		return
+	}
+	variable, value, local := call.Args[0].GetAConst(), call.Args[1].GetAConst(), call.Args[2].GetAConst()
+	if variable.GetSval() == nil || value.GetSval() == nil || local.GetBoolval() == nil {
+		return
+	}
+	set = SetConfig(variable.GetSval().Sval, value.GetSval().Sval)
+	set.Local = local.GetBoolval().Boolval
+	return set, true
+}
+
+// SetConfig returns a session variable change that is made using
+// `set_config(name, value, false)`, it is used for variables that are not
+// changed by statements of the client too (e.g. startup parameters)
+func SetConfig(name, value string) types.VariableSet {
+	return types.VariableSet{
+		Name:      strings.ToLower(name),
+		Statement: fmt.Sprintf("SELECT pg_catalog.set_config(%s, %s, false)", quoteLiteral(name), quoteLiteral(value)),
+	}
+}
+
+// quoteLiteral quotes a string constant, backslashes are escaped so it does
+// not depend on standard_conforming_strings
+func quoteLiteral(s string) string {
+	quoted := "'" + strings.ReplaceAll(s, "'", "''") + "'"
+	if strings.Contains(s, `\`) {
+		return "E" + strings.ReplaceAll(quoted, `\`, `\\`)
+	}
+	return quoted
+}
@@ -0,0 +1,46 @@
+package queryhelper
+
+import (
+	"reflect"
+	"testing"
+
+	_ "github.com/mhkarimi1383/pg_pro/config/configtest"
+	"github.com/mhkarimi1383/pg_pro/types"
+)
+
+func TestGetVariableSets(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []types.VariableSet
+	}{
+		{query: "SELECT 1"},
+		{query: "SET search_path TO app", want: []types.VariableSet{{Name: "search_path", Statement: "SET search_path TO app"}}},
+		{query: "SET LOCAL search_path TO app", want: []types.VariableSet{{Name: "search_path", Statement: "SET LOCAL search_path TO app", Local: true}}},
+		{query: "RESET ALL", want: []types.VariableSet{{Statement: "RESET ALL", ResetAll: true}}},
+		{
+			query: "SELECT set_config('Search_Path', 'app', false)",
+			want:  []types.VariableSet{{Name: "search_path", Statement: "SELECT pg_catalog.set_config('Search_Path', 'app', false)"}},
+		},
+		{
+			query: `SELECT pg_catalog.set_config('app.name', 'it''s a\b', true)`,
+			want:  []types.VariableSet{{Name: "app.name", Statement: `SELECT pg_catalog.set_config('app.name', E'it''s a\\b', false)`, Local: true}},
+		},
+		{query: "SELECT set_config('search_path', $1, false)"},
+		{query: "SELECT app.set_config('search_path', 'app', false)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			query, err := Parse(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := GetVariableSets(query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("sets = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package queryhelper
+
+import (
+	"strings"
+
+	pg_query "github.com/pganalyze/pg_query_go/v4"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/mhkarimi1383/pg_pro/config"
+	"github.com/mhkarimi1383/pg_pro/types"
+)
+
+var (
+	// volatileFunctions return a different result on every call
+	volatileFunctions = map[string]bool{
+		"now": true, "clock_timestamp": true, "statement_timestamp": true,
+		"transaction_timestamp": true, "timeofday": true,
+		"random": true, "random_normal": true, "setseed": true,
+		"gen_random_uuid": true, "uuid_generate_v1": true, "uuid_generate_v1mc": true, "uuid_generate_v4": true,
+		"pg_sleep": true, "pg_sleep_for": true, "pg_sleep_until": true,
+		"pg_backend_pid": true, "inet_client_addr": true, "inet_client_port": true,
+		"pg_is_in_recovery": true, "pg_last_wal_receive_lsn": true, "pg_last_wal_replay_lsn": true,
+		"pg_last_xact_replay_timestamp": true, "pg_postmaster_start_time": true, "pg_conf_load_time": true,
+		"txid_current_if_assigned": true, "pg_current_xact_id_if_assigned": true, "pg_current_wal_insert_lsn": true,
+	}
+	// writeFunctions have side effects (or depend on the session), so they
+	// have to run on the master
+	writeFunctions = map[string]bool{
+		"nextval": true, "setval": true, "currval": true, "lastval": true,
+		"set_config": true, "pg_notify": true,
+		"txid_current": true, "pg_current_xact_id": true, "pg_current_wal_lsn": true,
+		"pg_advisory_lock": true, "pg_advisory_lock_shared": true,
+		"pg_advisory_unlock": true, "pg_advisory_unlock_shared": true, "pg_advisory_unlock_all": true,
+		"pg_advisory_xact_lock": true, "pg_advisory_xact_lock_shared": true,
+		"pg_try_advisory_lock": true, "pg_try_advisory_lock_shared": true,
+		"pg_try_advisory_xact_lock": true, "pg_try_advisory_xact_lock_shared": true,
+		"lo_create": true, "lo_creat": true, "lo_import": true, "lo_unlink": true,
+		"lo_put": true, "lo_from_bytea": true,
+	}
+	// sessionFunctions leave state in the server session (session level
+	// advisory locks are held until they are unlocked)
+	sessionFunctions = map[string]bool{
+		"pg_advisory_lock": true, "pg_advisory_lock_shared": true,
+		"pg_try_advisory_lock": true, "pg_try_advisory_lock_shared": true,
+	}
+
+	// user defined functions could be configured by their name or their
+	// qualified name (schema.name)
+	allowedFunctions = functionSet(config.GetStringSlice("volatile_functions.allow"))
+	deniedFunctions  = functionSet(config.GetStringSlice("volatile_functions.deny"))
+	configuredWrites = functionSet(config.GetStringSlice("volatile_functions.write"))
+)
+
+func functionSet(names []string) map[string]bool {
+	set := map[string]bool{}
+	for _, name := range names {
+		set[strings.ToLower(name)] = true
+	}
+	return set
+}
+
+// GetQueryTraits finds volatile function calls, row locks, `SELECT INTO` and
+// data-modifying CTEs anywhere in the query, they make results non-cacheable
+// and some of them have to run on the master
+func GetQueryTraits(query *Query) (traits types.QueryTraits) {
+	traits.Cacheable = true
+	for _, i := range query.tree.Stmts {
+		traits.SessionState = traits.SessionState || !sessionFree(i.Stmt)
+	}
+	walk(query.tree.ProtoReflect(), func(m proto.Message) {
+		switch node := m.(type) {
+		case *pg_query.FuncCall:
+			name, qualifiedName := functionName(node.Funcname)
+			if sessionFunctions[name] {
+				traits.SessionState = true
+			} else if _, ok := setConfig(node); name == "set_config" && !ok {
+				// the variable could not be replayed
+				traits.SessionState = true
+			}
+			switch {
+			case writeFunctions[name] || configuredWrites[name] || configuredWrites[qualifiedName]:
+				traits.Cacheable = false
+				traits.RequiresMaster = true
+			case deniedFunctions[name] || deniedFunctions[qualifiedName]:
+				traits.Cacheable = false
+			case volatileFunctions[name] && !allowedFunctions[name] && !allowedFunctions[qualifiedName]:
+				traits.Cacheable = false
+			}
+		case *pg_query.SQLValueFunction:
+			// current_role, current_schema, ... are fine since role, database
+			// and session variables are part of cache keys
+			if node.Op <= pg_query.SQLValueFunctionOp_SVFOP_LOCALTIMESTAMP_N {
+				traits.Cacheable = false
+			}
+		case *pg_query.RangeTableSample:
+			if node.Repeatable == nil {
+				traits.Cacheable = false
+			}
+		case *pg_query.SelectStmt:
+			if len(node.LockingClause) > 0 {
+				traits.Cacheable = false
+				traits.RequiresMaster = true
+			}
+			if node.IntoClause != nil && node.IntoClause.Rel != nil {
+				// SELECT INTO is the same as CREATE TABLE AS
+				traits.Cacheable = false
+				traits.SessionState = traits.SessionState || node.IntoClause.Rel.Relpersistence == "t"
+				traits.Writes = append(traits.Writes, types.TableAccessInfo{
+					TableInfo: types.TableInfo{
+						Name:   node.IntoClause.Rel.Relname,
+						Schema: types.SchemaNameFixer(node.IntoClause.Rel.Schemaname),
+					},
+					AccessMode: types.System,
+				})
+			}
+		case *pg_query.CopyStmt:
+			// results of COPY are not relayed as rows
+			traits.Cacheable = false
+			if node.IsProgram || node.Filename != "" {
+				traits.SuperuserOnly = true
+			}
+		case *pg_query.VariableSetStmt, *pg_query.VariableShowStmt, *pg_query.DiscardStmt:
+			traits.Cacheable = false
+		case *pg_query.CommonTableExpr:
+			if write, ok := cteWrite(node.Ctequery); ok {
+				traits.Cacheable = false
+				traits.Writes = append(traits.Writes, write)
+			}
+		}
+	})
+	return
+}
+
+// sessionFree tells if a statement leaves no state in the server session
+// other than what pg_pro tracks (session variables and prepared statements),
+// DML and transaction control are fine, but anything else could create
+// temporary objects, LISTEN, ...
+func sessionFree(stmt *pg_query.Node) bool {
+	switch stmt.Node.(type) {
+	case *pg_query.Node_SelectStmt, *pg_query.Node_InsertStmt, *pg_query.Node_UpdateStmt,
+		*pg_query.Node_DeleteStmt, *pg_query.Node_MergeStmt, *pg_query.Node_CopyStmt,
+		*pg_query.Node_ExplainStmt, *pg_query.Node_TransactionStmt,
+		*pg_query.Node_VariableSetStmt, *pg_query.Node_VariableShowStmt,
+		*pg_query.Node_PrepareStmt, *pg_query.Node_DeallocateStmt, *pg_query.Node_DiscardStmt:
+		return true
+	}
+	return false
+}
+
+// functionName returns the unqualified and the qualified (if any) name of a
+// function
+func functionName(nodes []*pg_query.Node) (name, qualifiedName string) {
+	parts := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		parts = append(parts, strings.ToLower(node.GetString_().GetSval()))
+	}
+	if len(parts) == 0 {
+		return
+	}
+	return parts[len(parts)-1], strings.Join(parts, ".")
+}
+
+// cteWrite returns the table modified by a data-modifying CTE
+func cteWrite(query *pg_query.Node) (write types.TableAccessInfo, ok bool) {
+	var relation *pg_query.RangeVar
+	switch {
+	case query.GetInsertStmt() != nil:
+		relation, write.AccessMode = query.GetInsertStmt().Relation, types.Insert
+	case query.GetUpdateStmt() != nil:
+		relation, write.AccessMode = query.GetUpdateStmt().Relation, types.Update
+	case query.GetDeleteStmt() != nil:
+		relation, write.AccessMode = query.GetDeleteStmt().Relation, types.Delete
+	default:
+		return
+	}
+	write.TableInfo = types.TableInfo{
+		Name:   relation.Relname,
+		Schema: types.SchemaNameFixer(relation.Schemaname),
+	}
+	return write, true
+}
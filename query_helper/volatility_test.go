@@ -0,0 +1,77 @@
+package queryhelper
+
+import (
+	"reflect"
+	"testing"
+
+	_ "github.com/mhkarimi1383/pg_pro/config/configtest"
+	"github.com/mhkarimi1383/pg_pro/types"
+)
+
+// volatile functions are configured in config/testdata/config.yaml
+func TestGetQueryTraits(t *testing.T) {
+	cacheable := types.QueryTraits{Cacheable: true}
+	tests := []struct {
+		query string
+		want  types.QueryTraits
+	}{
+		{query: "SELECT * FROM users", want: cacheable},
+		{query: "SELECT now()", want: types.QueryTraits{}},
+		{query: "SELECT * FROM users WHERE created_at > NOW() - interval '1 day'", want: types.QueryTraits{}},
+		{query: "SELECT current_timestamp", want: types.QueryTraits{}},
+		{query: "SELECT current_user", want: cacheable},
+		{query: "SELECT random()", want: types.QueryTraits{}},
+		{query: "SELECT app.random()", want: cacheable},
+		{query: "SELECT app.rates()", want: types.QueryTraits{}},
+		{query: "SELECT rates()", want: cacheable},
+		{query: "SELECT audit(id) FROM users", want: types.QueryTraits{RequiresMaster: true}},
+		{query: "SELECT nextval('users_id_seq')", want: types.QueryTraits{RequiresMaster: true}},
+		{query: "SELECT * FROM users FOR UPDATE", want: types.QueryTraits{RequiresMaster: true}},
+		{query: "SELECT * FROM users TABLESAMPLE bernoulli (10)", want: types.QueryTraits{}},
+		{query: "SELECT * FROM users TABLESAMPLE bernoulli (10) REPEATABLE (1)", want: cacheable},
+		{query: "SELECT * FROM (SELECT random() FROM users) AS r", want: types.QueryTraits{}},
+		{query: "SET search_path TO app", want: types.QueryTraits{}},
+		{query: "SELECT set_config('search_path', 'app', false)", want: types.QueryTraits{RequiresMaster: true}},
+		{query: "SELECT set_config('search_path', $1, false)", want: types.QueryTraits{RequiresMaster: true, SessionState: true}},
+		{query: "SELECT pg_advisory_lock(1)", want: types.QueryTraits{RequiresMaster: true, SessionState: true}},
+		{query: "SELECT pg_advisory_xact_lock(1)", want: types.QueryTraits{RequiresMaster: true}},
+		{query: "CREATE TEMP TABLE t (id int)", want: types.QueryTraits{Cacheable: true, SessionState: true}},
+		{query: "LISTEN jobs", want: types.QueryTraits{Cacheable: true, SessionState: true}},
+		{query: "EXECUTE p", want: types.QueryTraits{Cacheable: true, SessionState: true}},
+		{query: "BEGIN", want: cacheable},
+		{
+			query: "SELECT * INTO archive.users FROM users",
+			want: types.QueryTraits{Writes: []types.TableAccessInfo{
+				{TableInfo: types.TableInfo{Schema: "archive", Name: "users"}, AccessMode: types.System},
+			}},
+		},
+		{
+			query: "SELECT * INTO TEMP users_copy FROM users",
+			want: types.QueryTraits{SessionState: true, Writes: []types.TableAccessInfo{
+				{TableInfo: types.TableInfo{Schema: "public", Name: "users_copy"}, AccessMode: types.System},
+			}},
+		},
+		{
+			query: "WITH d AS (DELETE FROM users RETURNING *) SELECT * FROM d",
+			want: types.QueryTraits{Writes: []types.TableAccessInfo{
+				{TableInfo: types.TableInfo{Schema: "public", Name: "users"}, AccessMode: types.Delete},
+			}},
+		},
+		{query: "WITH u AS (SELECT * FROM users) SELECT * FROM u", want: cacheable},
+		{query: "COPY users TO STDOUT", want: types.QueryTraits{}},
+		{query: "COPY (SELECT 1) TO STDOUT", want: types.QueryTraits{}},
+		{query: "COPY users FROM '/etc/passwd'", want: types.QueryTraits{SuperuserOnly: true}},
+		{query: "COPY users TO PROGRAM 'id'", want: types.QueryTraits{SuperuserOnly: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			query, err := Parse(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := GetQueryTraits(query); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("traits = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
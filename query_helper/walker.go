@@ -0,0 +1,147 @@
+package queryhelper
+
+import (
+	pg_query "github.com/pganalyze/pg_query_go/v4"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"github.com/mhkarimi1383/pg_pro/types"
+)
+
+// walk calls fn for every node of the parse tree (depth first)
+func walk(m protoreflect.Message, fn func(proto.Message)) {
+	fn(m.Interface())
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		if fd.Message() == nil || fd.IsMap() {
+			return true
+		}
+		if fd.IsList() {
+			list := v.List()
+			for i := 0; i < list.Len(); i++ {
+				walk(list.Get(i).Message(), fn)
+			}
+			return true
+		}
+		walk(v.Message(), fn)
+		return true
+	})
+}
+
+// GetDependencies returns every table referenced anywhere in the query
+// (joins, sub-queries, CTEs, ...), mostly used for cache invalidation
+func GetDependencies(query *Query) (tables []types.TableInfo) {
+	return referencedTables(query.tree.ProtoReflect())
+}
+
+// GetWrittenTables returns tables that could be modified by the query, every
+// table referenced by a statement other than SELECT is considered written
+// (e.g. by TRUNCATE, MERGE or ALTER TABLE), all is set when the modified
+// tables are unknown (`EXECUTE`, `CALL`, `DO` and `DROP SCHEMA`)
+func GetWrittenTables(query *Query) (tables []types.TableInfo, all bool) {
+	seen := map[types.TableInfo]bool{}
+	add := func(written []types.TableInfo) {
+		for _, table := range written {
+			if !seen[table] {
+				seen[table] = true
+				tables = append(tables, table)
+			}
+		}
+	}
+	for _, i := range query.tree.Stmts {
+		switch stmt := i.Stmt; {
+		case stmt.GetExecuteStmt() != nil, stmt.GetCallStmt() != nil, stmt.GetDoStmt() != nil:
+			return nil, true
+		case stmt.GetPrepareStmt() != nil:
+			// prepared statements write when they are executed
+		case stmt.GetSelectStmt() != nil:
+			add(selectWrites(stmt))
+		case stmt.GetDropStmt() != nil:
+			written, ok := droppedTables(stmt.GetDropStmt())
+			if !ok {
+				return nil, true
+			}
+			add(written)
+		default:
+			add(referencedTables(stmt.ProtoReflect()))
+		}
+	}
+	return
+}
+
+// referencedTables returns tables of every RangeVar under m, except the ones
+// referring to CTEs
+func referencedTables(m protoreflect.Message) (tables []types.TableInfo) {
+	cteNames := map[string]bool{}
+	var rangeVars []*pg_query.RangeVar
+	walk(m, func(m proto.Message) {
+		switch node := m.(type) {
+		case *pg_query.CommonTableExpr:
+			cteNames[node.Ctename] = true
+		case *pg_query.RangeVar:
+			rangeVars = append(rangeVars, node)
+		}
+	})
+
+	seen := map[types.TableInfo]bool{}
+	for _, rangeVar := range rangeVars {
+		if rangeVar.Schemaname == "" && cteNames[rangeVar.Relname] {
+			continue
+		}
+		table := types.TableInfo{
+			Name:   rangeVar.Relname,
+			Schema: types.SchemaNameFixer(rangeVar.Schemaname),
+		}
+		if !seen[table] {
+			seen[table] = true
+			tables = append(tables, table)
+		}
+	}
+	return
+}
+
+// selectWrites returns tables written by data-modifying CTEs and `SELECT
+// INTO` of a SELECT statement
+func selectWrites(stmt *pg_query.Node) (tables []types.TableInfo) {
+	walk(stmt.ProtoReflect(), func(m proto.Message) {
+		switch node := m.(type) {
+		case *pg_query.CommonTableExpr:
+			if write, ok := cteWrite(node.Ctequery); ok {
+				tables = append(tables, write.TableInfo)
+			}
+		case *pg_query.SelectStmt:
+			if node.IntoClause != nil && node.IntoClause.Rel != nil {
+				tables = append(tables, types.TableInfo{
+					Name:   node.IntoClause.Rel.Relname,
+					Schema: types.SchemaNameFixer(node.IntoClause.Rel.Schemaname),
+				})
+			}
+		}
+	})
+	return
+}
+
+// droppedTables returns relations dropped by `DROP TABLE`, `DROP VIEW`, ...,
+// ok is false when every table of the database could be affected
+func droppedTables(stmt *pg_query.DropStmt) (tables []types.TableInfo, ok bool) {
+	switch stmt.RemoveType {
+	case pg_query.ObjectType_OBJECT_SCHEMA:
+		return nil, false
+	case pg_query.ObjectType_OBJECT_TABLE, pg_query.ObjectType_OBJECT_VIEW,
+		pg_query.ObjectType_OBJECT_MATVIEW, pg_query.ObjectType_OBJECT_FOREIGN_TABLE:
+	default:
+		return nil, true
+	}
+	for _, object := range stmt.Objects {
+		items := object.GetList().GetItems()
+		if len(items) == 0 {
+			continue
+		}
+		table := types.TableInfo{Name: items[len(items)-1].GetString_().GetSval()}
+		if len(items) > 1 {
+			table.Schema = items[len(items)-2].GetString_().GetSval()
+		}
+		table.Schema = types.SchemaNameFixer(table.Schema)
+		tables = append(tables, table)
+	}
+	return tables, true
+}
@@ -0,0 +1,52 @@
+package queryhelper
+
+import (
+	"reflect"
+	"testing"
+
+	_ "github.com/mhkarimi1383/pg_pro/config/configtest"
+	"github.com/mhkarimi1383/pg_pro/types"
+)
+
+func TestGetWrittenTables(t *testing.T) {
+	users := types.TableInfo{Schema: "public", Name: "users"}
+	orders := types.TableInfo{Schema: "sales", Name: "orders"}
+	tests := []struct {
+		query string
+		want  []types.TableInfo
+		all   bool
+	}{
+		{query: "SELECT * FROM users"},
+		{query: "SELECT * FROM users FOR UPDATE"},
+		{query: "INSERT INTO users SELECT * FROM users", want: []types.TableInfo{users}},
+		{query: "UPDATE sales.orders SET paid = true FROM users", want: []types.TableInfo{orders, users}},
+		{query: "WITH d AS (DELETE FROM users RETURNING *) SELECT * FROM d", want: []types.TableInfo{users}},
+		{query: "SELECT * INTO sales.orders FROM users", want: []types.TableInfo{orders}},
+		{query: "TRUNCATE users, sales.orders", want: []types.TableInfo{users, orders}},
+		{
+			query: "MERGE INTO sales.orders o USING users u ON o.user_id = u.id WHEN MATCHED THEN DELETE",
+			want:  []types.TableInfo{orders, users},
+		},
+		{query: "ALTER TABLE users ADD COLUMN age int", want: []types.TableInfo{users}},
+		{query: "DROP TABLE users, sales.orders", want: []types.TableInfo{users, orders}},
+		{query: "DROP INDEX users_pkey"},
+		{query: "DROP SCHEMA sales CASCADE", all: true},
+		{query: "PREPARE p AS DELETE FROM users"},
+		{query: "EXECUTE p", all: true},
+		{query: "CALL archive_orders()", all: true},
+		{query: "DO $$ BEGIN DELETE FROM users; END $$", all: true},
+		{query: "SET search_path TO sales"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			query, err := Parse(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, all := GetWrittenTables(query)
+			if !reflect.DeepEqual(got, tt.want) || all != tt.all {
+				t.Fatalf("tables = %+v (all %v), want %+v (all %v)", got, all, tt.want, tt.all)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package tcpproxy
+
+import (
+	"crypto/rand"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/mhkarimi1383/pg_pro/auth"
+	"github.com/mhkarimi1383/pg_pro/logger"
+	"github.com/mhkarimi1383/pg_pro/types"
+	"github.com/mhkarimi1383/pg_pro/utils"
+)
+
+var (
+	errAuthFailed = errors.New("authentication failed")
+	// scramMockSecret derives verifiers of unknown users, it is generated per
+	// process
+	scramMockSecret = make([]byte, 32)
+)
+
+func init() {
+	if _, err := rand.Read(scramMockSecret); err != nil {
+		panic(errors.Wrap(err, "generating SCRAM mock secret"))
+	}
+}
+
+// authenticateMD5 is only used for users that opted-in for md5, salt is
+// generated per connection so responses could not be replayed
+func (s *session) authenticateMD5() error {
+	var salt [4]byte
+	if _, err := rand.Read(salt[:]); err != nil {
+		return errors.Wrap(err, "generating md5 salt")
+	}
+
+	s.backend.Send(&pgproto3.AuthenticationMD5Password{Salt: salt})
+	if err := s.backend.Flush(); err != nil {
+		return err
+	}
+	if err := s.backend.SetAuthType(pgproto3.AuthTypeMD5Password); err != nil {
+		return err
+	}
+
+	msg, err := s.backend.Receive()
+	if err != nil {
+		return errors.Wrap(err, "receive password from client")
+	}
+	password, ok := msg.(*pgproto3.PasswordMessage)
+	if !ok {
+		return errors.Errorf("unexpected message during authentication: %v", utils.GetType(msg))
+	}
+	if !auth.GetProvider().CheckMD5Auth(s.username, password.Password, salt) {
+		return errAuthFailed
+	}
+	return nil
+}
+
+func (s *session) authenticateSCRAM() error {
+	verifier, ok := auth.GetProvider().GetSCRAMVerifier(s.username)
+	if !ok {
+		// continue the exchange with a mock verifier, so clients could not
+		// find out which users exist
+		verifier = types.NewMockSCRAMVerifier(scramMockSecret, s.username)
+	}
+	scram := auth.NewSCRAMServer(verifier, s.channelBinding())
+
+	s.backend.Send(&pgproto3.AuthenticationSASL{AuthMechanisms: scram.Mechanisms()})
+	if err := s.backend.Flush(); err != nil {
+		return err
+	}
+	if err := s.backend.SetAuthType(pgproto3.AuthTypeSASL); err != nil {
+		return err
+	}
+
+	msg, err := s.backend.Receive()
+	if err != nil {
+		return errors.Wrap(err, "receive SASL initial response from client")
+	}
+	initial, ok := msg.(*pgproto3.SASLInitialResponse)
+	if !ok {
+		return errors.Errorf("unexpected message during authentication: %v", utils.GetType(msg))
+	}
+	serverFirst, err := scram.ServerFirst(initial.AuthMechanism, initial.Data)
+	if err != nil {
+		logger.Warn(err.Error(), zap.String("event", "authentication"))
+		return errAuthFailed
+	}
+
+	s.backend.Send(&pgproto3.AuthenticationSASLContinue{Data: serverFirst})
+	if err := s.backend.Flush(); err != nil {
+		return err
+	}
+	if err := s.backend.SetAuthType(pgproto3.AuthTypeSASLContinue); err != nil {
+		return err
+	}
+
+	msg, err = s.backend.Receive()
+	if err != nil {
+		return errors.Wrap(err, "receive SASL response from client")
+	}
+	response, ok := msg.(*pgproto3.SASLResponse)
+	if !ok {
+		return errors.Errorf("unexpected message during authentication: %v", utils.GetType(msg))
+	}
+	serverFinal, err := scram.ServerFinal(response.Data)
+	if err != nil {
+		if !errors.Is(err, auth.ErrSCRAMAuthFailed) {
+			logger.Warn(err.Error(), zap.String("event", "authentication"))
+		}
+		return errAuthFailed
+	}
+
+	s.backend.Send(&pgproto3.AuthenticationSASLFinal{Data: serverFinal})
+	return nil
+}
+
+// channelBinding returns the `tls-server-end-point` data of the client
+// connection, nil when TLS is not used
+func (s *session) channelBinding() []byte {
+	if !s.tls {
+		return nil
+	}
+	return tlsChannelBinding
+}
@@ -0,0 +1,90 @@
+package tcpproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/pkg/errors"
+)
+
+// users are configured in config/testdata/users.yaml
+func TestAuthenticate(t *testing.T) {
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		ok       bool
+	}{
+		{name: "scram", user: "user", password: "pencil", ok: true},
+		{name: "scram wrong password", user: "user", password: "pen"},
+		{name: "unknown user", user: "unknown", password: "pencil"},
+		{name: "md5", user: "md5_user", password: "secret", ok: true},
+		{name: "md5 wrong password", user: "md5_user", password: "pencil"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := dial(tt.user, tt.password, "postgres")
+			if err == nil {
+				conn.Close(context.Background())
+			}
+			if tt.ok {
+				if err != nil {
+					t.Fatalf("connect: %v", err)
+				}
+				return
+			}
+			var pgErr *pgconn.PgError
+			if !errors.As(err, &pgErr) {
+				t.Fatalf("error = %v, want a server error", err)
+			}
+			message := fmt.Sprintf("password authentication failed for user %q", tt.user)
+			if pgErr.Severity != "FATAL" || pgErr.Code != "28P01" || pgErr.Message != message {
+				t.Fatalf("error = %v %v %q, want FATAL 28P01 %q", pgErr.Severity, pgErr.Code, pgErr.Message, message)
+			}
+		})
+	}
+}
+
+func TestAuthenticationRequest(t *testing.T) {
+	tests := []struct {
+		user string
+		want pgproto3.BackendMessage
+	}{
+		{user: "user", want: &pgproto3.AuthenticationSASL{}},
+		// unknown users go through SCRAM too, so they could not be told apart
+		{user: "unknown", want: &pgproto3.AuthenticationSASL{}},
+		{user: "md5_user", want: &pgproto3.AuthenticationMD5Password{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.user, func(t *testing.T) {
+			client, proxy := net.Pipe()
+			defer client.Close()
+			go handleClient(proxy)
+
+			frontend := pgproto3.NewFrontend(client, client)
+			frontend.Send(&pgproto3.StartupMessage{
+				ProtocolVersion: pgproto3.ProtocolVersionNumber,
+				Parameters:      map[string]string{"user": tt.user, "database": "postgres"},
+			})
+			if err := frontend.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			msg, err := frontend.Receive()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := fmt.Sprintf("%T", msg), fmt.Sprintf("%T", tt.want); got != want {
+				t.Fatalf("authentication request = %v, want %v", got, want)
+			}
+			if sasl, ok := msg.(*pgproto3.AuthenticationSASL); ok {
+				if len(sasl.AuthMechanisms) != 1 || sasl.AuthMechanisms[0] != "SCRAM-SHA-256" {
+					t.Fatalf("mechanisms = %v, want SCRAM-SHA-256", sasl.AuthMechanisms)
+				}
+			}
+		})
+	}
+}
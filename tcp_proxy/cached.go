@@ -0,0 +1,108 @@
+package tcpproxy
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/mhkarimi1383/pg_pro/cache"
+	"github.com/mhkarimi1383/pg_pro/connection"
+	"github.com/mhkarimi1383/pg_pro/logger"
+	"github.com/mhkarimi1383/pg_pro/types"
+)
+
+// cachedRead serves a read from the cache, or from the result of the same
+// read that is running concurrently, messages are the frontend messages of the
+// read (used for refreshing stale results) and send writes a result to the
+// client. When the read could not be served, the caller has to run it and
+// finish the returned flight.
+func (s *session) cachedRead(
+	key *cache.Key,
+	info *queryInfo,
+	messages []pgproto3.FrontendMessage,
+	send func(*types.QueryResult) error,
+) (served bool, flight *cache.Flight, err error) {
+	result, stale, err := cache.Get(key)
+	if err != nil {
+		logger.Debug(err.Error(), zap.String("event", "cache_read"))
+	}
+	if result != nil {
+		if stale {
+			revalidate(s.route, key, info, messages)
+		}
+		return true, nil, send(result)
+	}
+
+	flight, leader := cache.JoinFlight(key)
+	if leader {
+		return false, flight, nil
+	}
+	if result := flight.Wait(); result != nil {
+		return true, nil, send(result)
+	}
+	return false, nil, nil
+}
+
+// revalidate refreshes a stale result in background, only one refresh of a key
+// runs at a time
+func revalidate(route connection.Route, key *cache.Key, info *queryInfo, messages []pgproto3.FrontendMessage) {
+	flight, leader := cache.JoinFlight(key)
+	if !leader {
+		return
+	}
+	go func() {
+		result, err := refresh(route, key, info, messages)
+		if err != nil {
+			logger.Warn(err.Error(), zap.String("event", "cache_revalidate"))
+		}
+		flight.Finish(result)
+	}()
+}
+
+// refresh runs a read on a replica and caches its result, result is nil when
+// it could not be cached
+func refresh(route connection.Route, key *cache.Key, info *queryInfo, messages []pgproto3.FrontendMessage) (*types.QueryResult, error) {
+	ctx := context.Background()
+	server, lsn, err := connection.AcquireReplica(ctx, route, connection.ReadRequirements{MaxLag: info.maxReplicaLag})
+	if err != nil {
+		return nil, err
+	}
+	dirty, err := replaySettings(server, key.Settings)
+	defer releaseServerConn(server, dirty)
+	if err != nil {
+		return nil, err
+	}
+
+	startedAt := time.Now()
+	frontend := server.Conn().PgConn().Frontend()
+	for _, msg := range messages {
+		frontend.Send(msg)
+	}
+	if _, ok := messages[0].(*pgproto3.Query); !ok {
+		frontend.Send(&pgproto3.Sync{})
+	}
+	if err := frontend.Flush(); err != nil {
+		closeServer(server)
+		return nil, errors.Wrap(err, "sending messages to server")
+	}
+
+	collector := newResultCollector(info.cachePolicy.MaxResultSize)
+	for {
+		msg, err := server.Conn().PgConn().ReceiveMessage(ctx)
+		if err != nil {
+			closeServer(server)
+			return nil, errors.Wrap(err, "receive server message")
+		}
+		collector.collect(msg)
+		if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+			break
+		}
+	}
+	if !collector.cacheable() {
+		return nil, nil
+	}
+	return &collector.result, cache.Set(key, &collector.result, info.cachePolicy, info.dependencies, startedAt, lsn)
+}
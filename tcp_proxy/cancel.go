@@ -0,0 +1,114 @@
+package tcpproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/mhkarimi1383/pg_pro/logger"
+)
+
+// Queries of a client run on different server connections, so clients get a
+// BackendKeyData issued by pg_pro and their cancel requests are forwarded to
+// the server connection that is running a query of the client at that moment
+
+const cancelTimeout = 5 * time.Second
+
+// errCancelRequest is returned by startup when the connection was only used
+// to send a cancel request
+var errCancelRequest = errors.New("cancel request")
+
+type cancelKey struct {
+	processID uint32
+	secretKey uint32
+}
+
+var (
+	cancelKeysLock sync.Mutex
+	cancelKeys     = map[cancelKey]*session{}
+)
+
+// registerCancelKey issues a new key for the session
+func (s *session) registerCancelKey() (*pgproto3.BackendKeyData, error) {
+	buf := make([]byte, 8)
+	cancelKeysLock.Lock()
+	defer cancelKeysLock.Unlock()
+	for {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, errors.Wrap(err, "generating cancel key")
+		}
+		key := cancelKey{
+			processID: binary.BigEndian.Uint32(buf[:4]),
+			secretKey: binary.BigEndian.Uint32(buf[4:]),
+		}
+		if _, ok := cancelKeys[key]; ok || key.processID == 0 {
+			continue
+		}
+		cancelKeys[key] = s
+		s.cancelKey = key
+		return &pgproto3.BackendKeyData{ProcessID: key.processID, SecretKey: key.secretKey}, nil
+	}
+}
+
+func (s *session) unregisterCancelKey() {
+	cancelKeysLock.Lock()
+	defer cancelKeysLock.Unlock()
+	if cancelKeys[s.cancelKey] == s {
+		delete(cancelKeys, s.cancelKey)
+	}
+}
+
+// setRunning records the server connection that is running a query of the
+// client, nil means nothing is running
+func (s *session) setRunning(server *pgxpool.Conn) {
+	s.runningLock.Lock()
+	defer s.runningLock.Unlock()
+	s.running = nil
+	if server != nil {
+		s.running = server.Conn().PgConn()
+	}
+}
+
+// cancel forwards a cancel request to the server connection that is running
+// a query of the session, the connection is not released while sending it
+func (s *session) cancel() error {
+	s.runningLock.Lock()
+	defer s.runningLock.Unlock()
+	if s.running == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cancelTimeout)
+	defer cancel()
+	return errors.Wrap(s.running.CancelRequest(ctx), "sending cancel request to server")
+}
+
+// handleCancelRequest cancels the running query of the session owning the
+// key, like postgres nothing is sent back to the client
+func handleCancelRequest(msg *pgproto3.CancelRequest) error {
+	cancelKeysLock.Lock()
+	s, ok := cancelKeys[cancelKey{processID: msg.ProcessID, secretKey: msg.SecretKey}]
+	cancelKeysLock.Unlock()
+	if !ok {
+		logger.Debug(
+			"received cancel request with unknown key",
+			zap.String("event", "cancel"),
+		)
+		return errCancelRequest
+	}
+	logger.Debug(
+		"forwarding cancel request",
+		zap.String("event", "cancel"),
+		zap.String("user", s.username),
+	)
+	if err := s.cancel(); err != nil {
+		return err
+	}
+	return errCancelRequest
+}
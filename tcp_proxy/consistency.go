@@ -0,0 +1,54 @@
+package tcpproxy
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/mhkarimi1383/pg_pro/config"
+	"github.com/mhkarimi1383/pg_pro/connection"
+	"github.com/mhkarimi1383/pg_pro/logger"
+)
+
+// readYourWritesWindow is how long reads of a session have to see its own
+// writes, 0 disables read-your-writes consistency
+var readYourWritesWindow = config.GetDuration("read_your_writes.window") * time.Second
+
+// readRequirements returns requirements of the replica serving a read of
+// this session, fresh is true when the session has written recently so
+// cached results could not be used
+func (s *session) readRequirements(maxLag time.Duration) (req connection.ReadRequirements, fresh bool) {
+	req.MaxLag = maxLag
+	if readYourWritesWindow > 0 && !s.lastWriteAt.IsZero() && time.Since(s.lastWriteAt) < readYourWritesWindow {
+		req.MinLSN = s.lastWriteLSN
+		fresh = true
+	}
+	return
+}
+
+// trackWrite records LSN of the master after writes of the session got
+// committed, it is called after the server became ready for query, the LSN
+// is used for read-your-writes and for invalidating cached results
+func (s *session) trackWrite() {
+	if !s.pendingWrite || s.txStatus != 'I' {
+		return
+	}
+	s.pendingWrite = false
+	if readYourWritesWindow == 0 && !s.invalidationPending() {
+		return
+	}
+	s.lastWriteAt = time.Now()
+
+	lsn, err := connection.CurrentLSN(context.Background(), s.route)
+	if err != nil {
+		logger.Warn(
+			err.Error(),
+			zap.String("event", "read_your_writes"),
+		)
+		// no replica could be trusted, so reads go to the master
+		lsn = math.MaxUint64
+	}
+	s.lastWriteLSN = lsn
+}
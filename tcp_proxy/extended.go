@@ -0,0 +1,422 @@
+package tcpproxy
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/mhkarimi1383/pg_pro/cache"
+	"github.com/mhkarimi1383/pg_pro/logger"
+	msghelper "github.com/mhkarimi1383/pg_pro/msg_helper"
+	"github.com/mhkarimi1383/pg_pro/types"
+)
+
+// preparedStatement is created by a Parse message, access checks and
+// classification happen once and are reused by every Execute
+type preparedStatement struct {
+	name string
+	// serverName is the name of named statements on servers and parse is
+	// used to prepare them again on other server connections
+	serverName    string
+	parse         *pgproto3.Parse
+	info          *queryInfo
+	parameterOIDs []uint32
+	bound         bool
+	batchID       uint64
+	// pending is set until the server (or pg_pro) completes the Parse, the
+	// statement is dropped when the Parse fails or is never run
+	pending bool
+}
+
+// portal is created by a Bind message
+type portal struct {
+	name      string
+	statement *preparedStatement
+	batchID   uint64
+}
+
+func (s *session) handleParse(msg *pgproto3.Parse) error {
+	if s.ignoreTillSync {
+		return nil
+	}
+	if _, ok := s.statements[msg.Name]; ok && msg.Name != "" {
+		return s.batchFailed(&pgconn.PgError{
+			Severity: "ERROR",
+			Code:     "42P05", // duplicate_prepared_statement
+			Message:  fmt.Sprintf("prepared statement %q already exists", msg.Name),
+		})
+	}
+	info, err := s.classify(msg.Query)
+	if err != nil {
+		return s.batchFailed(err)
+	}
+
+	s.dropStatement(msg.Name)
+	parse := *msg
+	statement := &preparedStatement{
+		name:          msg.Name,
+		parse:         &parse,
+		info:          info,
+		parameterOIDs: msg.ParameterOIDs,
+		batchID:       s.batchID,
+		pending:       true,
+	}
+	if msg.Name != "" {
+		statement.serverName = s.serverStatementName(msg)
+		parse.Name = statement.serverName
+		s.serverStatements[statement.serverName] = statement
+	}
+	s.statements[msg.Name] = statement
+
+	s.enqueue(&parse)
+	return nil
+}
+
+func (s *session) handleBind(msg *pgproto3.Bind) error {
+	if s.ignoreTillSync {
+		return nil
+	}
+	statement, err := s.lookupStatement(msg.PreparedStatement)
+	if err != nil {
+		return s.batchFailed(err)
+	}
+	if msg.DestinationPortal != "" || (statement.name == "" && statement.batchID != s.batchID) {
+		s.batchReadOnly = false
+	}
+	statement.bound = true
+
+	s.portals[msg.DestinationPortal] = &portal{
+		name:      msg.DestinationPortal,
+		statement: statement,
+		batchID:   s.batchID,
+	}
+
+	bind := *msg
+	bind.PreparedStatement = statement.serverName
+	bind.Parameters = copyValues(msg.Parameters)
+	s.enqueue(&bind)
+	return nil
+}
+
+func (s *session) handleDescribe(msg *pgproto3.Describe) error {
+	if s.ignoreTillSync {
+		return nil
+	}
+	describe := *msg
+	switch msg.ObjectType {
+	case 'S':
+		statement, err := s.lookupStatement(msg.Name)
+		if err != nil {
+			return s.batchFailed(err)
+		}
+		if msg.Name == "" && statement.batchID != s.batchID {
+			s.batchReadOnly = false
+		}
+		describe.Name = statement.serverName
+	case 'P':
+		p, err := s.lookupPortal(msg.Name)
+		if err != nil {
+			return s.batchFailed(err)
+		}
+		if msg.Name != "" || p.batchID != s.batchID {
+			s.batchReadOnly = false
+		}
+	}
+
+	s.enqueue(&describe)
+	return nil
+}
+
+func (s *session) handleExecute(msg *pgproto3.Execute) error {
+	if s.ignoreTillSync {
+		return nil
+	}
+	p, err := s.lookupPortal(msg.Portal)
+	if err != nil {
+		return s.batchFailed(err)
+	}
+	if msg.Portal != "" || p.batchID != s.batchID || !p.statement.info.isRead {
+		s.batchReadOnly = false
+	}
+	if !p.statement.info.isRead {
+		s.startWrite(p.statement.info)
+	}
+	if s.batchExecutes == 0 {
+		s.batchMaxReplicaLag = p.statement.info.maxReplicaLag
+	} else {
+		s.batchMaxReplicaLag = stricterLag(s.batchMaxReplicaLag, p.statement.info.maxReplicaLag)
+	}
+	s.batchExecutes++
+
+	execute := *msg
+	s.enqueue(&execute)
+	return nil
+}
+
+func (s *session) handleClose(msg *pgproto3.Close) error {
+	if s.ignoreTillSync {
+		return nil
+	}
+	switch msg.ObjectType {
+	case 'S':
+		s.dropStatement(msg.Name)
+	case 'P':
+		delete(s.portals, msg.Name)
+	}
+	s.batchReadOnly = false
+
+	closeMsg := *msg
+	s.enqueue(&closeMsg)
+	return nil
+}
+
+func (s *session) lookupStatement(name string) (*preparedStatement, error) {
+	statement, ok := s.statements[name]
+	if !ok {
+		message := fmt.Sprintf("prepared statement %q does not exist", name)
+		if name == "" {
+			message = "unnamed prepared statement does not exist"
+		}
+		return nil, &pgconn.PgError{
+			Severity: "ERROR",
+			Code:     "26000", // invalid_sql_statement_name
+			Message:  message,
+		}
+	}
+	return statement, nil
+}
+
+func (s *session) lookupPortal(name string) (*portal, error) {
+	p, ok := s.portals[name]
+	if !ok {
+		return nil, &pgconn.PgError{
+			Severity: "ERROR",
+			Code:     "34000", // invalid_cursor_name
+			Message:  fmt.Sprintf("portal %q does not exist", name),
+		}
+	}
+	return p, nil
+}
+
+// dropStatement removes a statement and every portal created from it
+func (s *session) dropStatement(name string) {
+	statement, ok := s.statements[name]
+	if !ok {
+		return
+	}
+	delete(s.statements, name)
+	if s.serverStatements[statement.serverName] == statement {
+		delete(s.serverStatements, statement.serverName)
+	}
+	for portalName, p := range s.portals {
+		if p.statement == statement {
+			delete(s.portals, portalName)
+		}
+	}
+}
+
+// dropPending drops statements whose Parse has failed or was discarded
+func (s *session) dropPending() {
+	for name, statement := range s.statements {
+		if statement.pending {
+			s.dropStatement(name)
+		}
+	}
+}
+
+// needsServer tells if statements of the client still need the master
+// connection, named statements are prepared again on other connections and
+// the unnamed statement is only kept until it gets used once
+func (s *session) needsServer() bool {
+	statement, ok := s.statements[""]
+	return ok && !statement.bound
+}
+
+func (s *session) enqueue(msg pgproto3.FrontendMessage) {
+	if s.ignoreTillSync {
+		return
+	}
+	s.batch = append(s.batch, msg)
+}
+
+// flushBatch sends the queued extended protocol messages to the server and
+// relays the responses, sync tells if the client sent Sync or Flush
+func (s *session) flushBatch(sync bool) error {
+	if s.ignoreTillSync {
+		if !sync {
+			return nil
+		}
+		s.ignoreTillSync = false
+		if !s.flushed || s.server == nil {
+			s.resetBatch(sync)
+			s.dropPending()
+			s.applySettings()
+			s.backend.Send(&pgproto3.ReadyForQuery{TxStatus: s.txStatus})
+			return s.backend.Flush()
+		}
+		// server has failed in place of the rejected message, it is
+		// waiting for the Sync too
+	}
+
+	readOnly := sync && !s.flushed && s.txStatus == 'I' && s.batchReadOnly && s.batchExecutes > 0 && !s.sessionLocal
+	var (
+		key    *cache.Key
+		info   *queryInfo
+		parsed bool
+	)
+	if readOnly {
+		key, info, parsed = s.batchCacheKey()
+	}
+	var flight *cache.Flight
+	if _, fresh := s.readRequirements(s.batchMaxReplicaLag); key != nil && !fresh {
+		messages := append([]pgproto3.FrontendMessage{}, s.batch...)
+		served, f, err := s.cachedRead(key, info, messages, func(result *types.QueryResult) error {
+			s.resetBatch(sync)
+			s.dropStatement("")
+			return s.sendResult(result, parsed, true)
+		})
+		if served || err != nil {
+			return err
+		}
+		flight = f
+	}
+	// result is shared with identical reads waiting for this one
+	var shared *types.QueryResult
+	if flight != nil {
+		defer func() { flight.Finish(shared) }()
+	}
+
+	server, lsn, dirty, err := s.batchServer(readOnly)
+	if err != nil {
+		s.resetBatch(sync)
+		if sync {
+			return s.queryFailed(err)
+		}
+		return s.batchFailed(err)
+	}
+	if readOnly {
+		defer releaseServerConn(server, dirty)
+		// unnamed statement and portal of this batch are only known to the
+		// replica, so they could not be used after the batch
+		s.dropStatement("")
+	}
+	s.setRunning(server)
+	defer s.setRunning(nil)
+
+	startedAt := time.Now()
+	frontend := server.Conn().PgConn().Frontend()
+	for _, msg := range s.planBatch(server) {
+		frontend.Send(msg)
+	}
+	s.resetBatch(sync)
+
+	if sync {
+		frontend.Send(&pgproto3.Sync{})
+	} else {
+		frontend.Send(&pgproto3.Flush{})
+	}
+	if err := frontend.Flush(); err != nil {
+		closeServer(server)
+		return errors.Wrap(err, "sending messages to server")
+	}
+
+	if !sync {
+		return s.relayResponses(server)
+	}
+	var collector *resultCollector
+	if key != nil {
+		collector = newResultCollector(info.cachePolicy.MaxResultSize)
+	}
+	if err := s.relay(server, collector, true); err != nil {
+		return err
+	}
+	if collector != nil && collector.cacheable() {
+		shared = &collector.result
+		if err := cache.Set(key, &collector.result, info.cachePolicy, info.dependencies, startedAt, lsn); err != nil {
+			logger.Warn(err.Error(), zap.String("event", "cache_set"))
+		}
+	}
+	if !readOnly {
+		s.trackWrite()
+		s.invalidateCache()
+	}
+	s.applySettings()
+	return nil
+}
+
+// batchCacheKey returns the cache key of batches that only run a single read
+// using the unnamed statement and portal (Parse, Bind, Describe and Execute),
+// results of other batches are not cached
+func (s *session) batchCacheKey() (key *cache.Key, info *queryInfo, parsed bool) {
+	messages := s.batch
+	if len(messages) > 0 {
+		if _, ok := messages[0].(*pgproto3.Parse); ok {
+			parsed = true
+			messages = messages[1:]
+		}
+	}
+	if len(messages) != 3 {
+		return nil, nil, false
+	}
+	// named statements are prepared on demand, they are not cached
+	bind, ok := messages[0].(*pgproto3.Bind)
+	if !ok || bind.PreparedStatement != "" {
+		return nil, nil, false
+	}
+	if describe, ok := messages[1].(*pgproto3.Describe); !ok || describe.ObjectType != 'P' {
+		return nil, nil, false
+	}
+	// results of partial executions are not cached
+	if execute, ok := messages[2].(*pgproto3.Execute); !ok || execute.MaxRows != 0 {
+		return nil, nil, false
+	}
+	statement, ok := s.statements[bind.PreparedStatement]
+	if !ok || !statement.info.cacheable {
+		return nil, nil, false
+	}
+	return s.cacheKey(statement.info, statement, bind), statement.info, parsed
+}
+
+// batchServer returns a replica connection for self-contained read only
+// batches and the master connection of the session for everything else
+func (s *session) batchServer(readOnly bool) (server *pgxpool.Conn, lsn uint64, dirty bool, err error) {
+	if readOnly {
+		req, _ := s.readRequirements(s.batchMaxReplicaLag)
+		return s.acquireReplica(req)
+	}
+	server, err = s.acquireServer()
+	return server, math.MaxUint64, false, err
+}
+
+func (s *session) resetBatch(sync bool) {
+	s.batch = s.batch[:0]
+	s.batchID++
+	s.batchReadOnly = true
+	s.batchExecutes = 0
+	s.flushed = !sync
+}
+
+// batchFailed reports an error to the client and discards extended protocol
+// messages until the next Sync, just like postgres itself. Messages queued
+// before the error are still run and the server fails in place of the
+// rejected message, so their responses come before the error and the
+// (implicit or explicit) transaction is aborted.
+func (s *session) batchFailed(err error) error {
+	if len(s.batch) > 0 || (s.server != nil && (s.flushed || s.txStatus == 'T')) {
+		s.batch = append(s.batch, newRejection(err))
+		err := s.flushBatch(false)
+		s.ignoreTillSync = true
+		return err
+	}
+	s.batch = s.batch[:0]
+	s.dropPending()
+	s.ignoreTillSync = true
+	s.backend.Send(msghelper.ErrorResponse(err))
+	return s.backend.Flush()
+}
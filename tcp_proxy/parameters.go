@@ -0,0 +1,202 @@
+package tcpproxy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/mhkarimi1383/pg_pro/auth"
+	"github.com/mhkarimi1383/pg_pro/config"
+	"github.com/mhkarimi1383/pg_pro/connection"
+	"github.com/mhkarimi1383/pg_pro/logger"
+	queryhelper "github.com/mhkarimi1383/pg_pro/query_helper"
+)
+
+// connectionParameters are startup parameters that are not session variables
+var connectionParameters = map[string]bool{
+	"user":        true,
+	"database":    true,
+	"replication": true,
+	"options":     true,
+}
+
+// startupParameters returns session variables given in the startup message,
+// as parameters (e.g. TimeZone or application_name) or as `-c name=value`
+// in options
+func startupParameters(msg *pgproto3.StartupMessage) (map[string]string, error) {
+	parameters := map[string]string{}
+	for name, value := range msg.Parameters {
+		if !connectionParameters[name] {
+			parameters[name] = value
+		}
+	}
+	options, err := parseOptions(msg.Parameters["options"])
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range options {
+		parameters[name] = value
+	}
+	return parameters, nil
+}
+
+// parseOptions parses the options startup parameter, only `-c name=value` and
+// `--name=value` are supported, spaces could be escaped by a backslash
+func parseOptions(options string) (map[string]string, error) {
+	var (
+		args    []string
+		arg     strings.Builder
+		escaped bool
+		inArg   bool
+	)
+	for _, r := range options {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped, inArg = true, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+
+	parameters := map[string]string{}
+	for i := 0; i < len(args); i++ {
+		var setting string
+		switch {
+		case args[i] == "-c" && i+1 < len(args):
+			i++
+			setting = args[i]
+		case strings.HasPrefix(args[i], "-c") && args[i] != "-c":
+			setting = args[i][2:]
+		case strings.HasPrefix(args[i], "--"):
+			setting = args[i][2:]
+		}
+		name, value, ok := strings.Cut(setting, "=")
+		if !ok || name == "" {
+			return nil, &pgconn.PgError{
+				Severity: "FATAL",
+				Code:     "42601", // syntax_error
+				Message:  fmt.Sprintf("invalid command-line argument for server process: %s", args[i]),
+				Hint:     "pg_pro only supports -c name=value and --name=value options.",
+			}
+		}
+		parameters[strings.ReplaceAll(name, "-", "_")] = value
+	}
+	return parameters, nil
+}
+
+// applyStartupParameters initializes session variables of the client using
+// its startup parameters, they are replayed like SET statements (and are part
+// of cache keys), parameters that are the same as the defaults of the master
+// are skipped
+func (s *session) applyStartupParameters(parameters map[string]string) {
+	defaults := connection.ParameterStatuses(s.route)
+	for name, value := range parameters {
+		if value == parameterValue(defaults, name) {
+			continue
+		}
+		set := queryhelper.SetConfig(name, value)
+		s.settings[set.Name] = set.Statement
+	}
+}
+
+// sendParameterStatuses reports parameters of the master to the client,
+// parameters describing the session itself are reported as if the client was
+// connected to postgres directly. When startup parameters are applied, values
+// that are in effect on a server connection of the client are reported, so
+// invalid values fail like they do on postgres.
+func (s *session) sendParameterStatuses(parameters map[string]string) error {
+	s.parameters = connection.ParameterStatuses(s.route)
+	if s.parameters["server_version"] == "" {
+		// master is not reachable yet
+		s.parameters["server_version"] = config.GetString("pg_version")
+	}
+	if _, ok := s.parameters["application_name"]; !ok {
+		s.parameters["application_name"] = ""
+	}
+	for name, value := range parameters {
+		if reported := reportedName(s.parameters, name); reported != "" {
+			s.parameters[reported] = value
+		}
+	}
+	if len(s.settings) > 0 {
+		server, err := s.acquireServer()
+		var pgErr *pgconn.PgError
+		switch {
+		case errors.As(err, &pgErr):
+			fatal := *pgErr
+			fatal.Severity = "FATAL"
+			return &fatal
+		case err != nil:
+			// values are checked when the client runs its first query
+			logger.Warn(
+				err.Error(),
+				zap.String("event", "parameter_status"),
+			)
+		default:
+			for name := range s.parameters {
+				if value := server.Conn().PgConn().ParameterStatus(name); value != "" {
+					s.parameters[name] = value
+				}
+			}
+		}
+	}
+	s.parameters["is_superuser"] = "off"
+	if auth.GetProvider().IsSuperUser(s.username) {
+		s.parameters["is_superuser"] = "on"
+	}
+	s.parameters["session_authorization"] = s.username
+
+	names := make([]string, 0, len(s.parameters))
+	for name := range s.parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s.backend.Send(&pgproto3.ParameterStatus{Name: name, Value: s.parameters[name]})
+	}
+	return nil
+}
+
+// reportedName returns the name of a reported parameter (e.g. `TimeZone` for
+// `timezone`), it is empty when the parameter is not reported
+func reportedName(parameters map[string]string, name string) string {
+	for reported := range parameters {
+		if strings.EqualFold(reported, name) {
+			return reported
+		}
+	}
+	return ""
+}
+
+func parameterValue(parameters map[string]string, name string) string {
+	return parameters[reportedName(parameters, name)]
+}
+
+// parameterChanged records a ParameterStatus of the server, it returns false
+// when the client already knows the value (e.g. it is reported by another
+// server connection that has the same value)
+func (s *session) parameterChanged(msg *pgproto3.ParameterStatus) bool {
+	if value, ok := s.parameters[msg.Name]; ok && value == msg.Value {
+		return false
+	}
+	s.parameters[msg.Name] = msg.Value
+	return true
+}
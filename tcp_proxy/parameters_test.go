@@ -0,0 +1,54 @@
+package tcpproxy
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+
+	_ "github.com/mhkarimi1383/pg_pro/config/configtest"
+)
+
+func TestStartupParameters(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		want       map[string]string
+		wantErr    bool
+	}{
+		{
+			name:       "connection parameters",
+			parameters: map[string]string{"user": "user", "database": "postgres", "replication": "false"},
+			want:       map[string]string{},
+		},
+		{
+			name:       "session variables",
+			parameters: map[string]string{"user": "user", "TimeZone": "UTC", "DateStyle": "ISO, MDY", "application_name": "psql"},
+			want:       map[string]string{"TimeZone": "UTC", "DateStyle": "ISO, MDY", "application_name": "psql"},
+		},
+		{
+			name:       "options",
+			parameters: map[string]string{"options": `-c search_path=app -cstatement_timeout=5s --lock-timeout=1s -c application_name=my\ app`},
+			want:       map[string]string{"search_path": "app", "statement_timeout": "5s", "lock_timeout": "1s", "application_name": "my app"},
+		},
+		{
+			name:       "options override parameters",
+			parameters: map[string]string{"search_path": "public", "options": "-c search_path=app"},
+			want:       map[string]string{"search_path": "app"},
+		},
+		{name: "unsupported option", parameters: map[string]string{"options": "-d 5"}, wantErr: true},
+		{name: "option without value", parameters: map[string]string{"options": "-c search_path"}, wantErr: true},
+		{name: "missing option", parameters: map[string]string{"options": "-c"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := startupParameters(&pgproto3.StartupMessage{Parameters: tt.parameters})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parameters = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
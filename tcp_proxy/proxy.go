@@ -1,28 +1,35 @@
 package tcpproxy
 
 import (
-	"log"
+	"io"
 	"net"
 
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
 	"github.com/mhkarimi1383/pg_pro/config"
-	"github.com/mhkarimi1383/pg_pro/connection"
+	"github.com/mhkarimi1383/pg_pro/logger"
 )
 
 func Serve() error {
-	addr, err := net.ResolveTCPAddr("tcp", ":"+config.GetString("listen_port"))
-	if err != nil {
+	if err := loadTLSConfig(); err != nil {
 		return err
 	}
 
-	listener, err := net.ListenTCP("tcp", addr)
+	listener, err := net.Listen("tcp", ":"+config.GetString("listen_port"))
 	if err != nil {
 		return err
 	}
+	defer listener.Close()
 
-	log.Printf("Proxy server started on port %v", config.GetString("listen_port"))
+	logger.Info(
+		"listener started",
+		zap.String("event", "listen"),
+		zap.String("port", config.GetString("listen_port")),
+	)
 
 	for {
-		clientConn, err := listener.AcceptTCP()
+		clientConn, err := listener.Accept()
 		if err != nil {
 			return err
 		}
@@ -31,47 +38,20 @@ func Serve() error {
 	}
 }
 
-func handleClient(cliConn *net.TCPConn) {
-	defer cliConn.Close()
-
-	serverConn, err := connection.GetRawConnection()
-	if err != nil {
-		log.Printf("Failed to connect to server: %s", err)
-		return
-	}
-	defer serverConn.Close()
-
-	Proxy(serverConn.(*net.TCPConn), cliConn)
-}
-
-func Proxy(srvConn, cliConn *net.TCPConn) {
-	serverClosed := make(chan struct{}, 1)
-	clientClosed := make(chan struct{}, 1)
-
-	go broker(srvConn, cliConn, clientClosed)
-	go broker(cliConn, srvConn, serverClosed)
-
-	var waitFor chan struct{}
-	select {
-	case <-clientClosed:
-		srvConn.SetLinger(0)
-		srvConn.CloseRead()
-		waitFor = serverClosed
-	case <-serverClosed:
-		cliConn.CloseRead()
-		waitFor = clientClosed
-	}
-
-	<-waitFor
-}
-
-func broker(dst, src net.Conn, srcClosed chan struct{}) {
-	_, err := copyBuffer(dst, src, nil)
-	if err != nil {
-		log.Printf("Copy error: %s", err)
-	}
-	if err := src.Close(); err != nil {
-		log.Printf("Close error: %s", err)
+func handleClient(cliConn net.Conn) {
+	s := newSession(cliConn)
+	defer s.close()
+
+	err := s.serve()
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		logger.Info(
+			"EOF error possibly a client disconected unexpectedly",
+			zap.String("event", "handle connection"),
+		)
+	} else if err != nil {
+		logger.Warn(
+			err.Error(),
+			zap.String("event", "handle connection"),
+		)
 	}
-	srcClosed <- struct{}{}
 }
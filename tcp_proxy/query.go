@@ -0,0 +1,284 @@
+package tcpproxy
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/mhkarimi1383/pg_pro/auth"
+	"github.com/mhkarimi1383/pg_pro/cache"
+	"github.com/mhkarimi1383/pg_pro/logger"
+	msghelper "github.com/mhkarimi1383/pg_pro/msg_helper"
+	queryhelper "github.com/mhkarimi1383/pg_pro/query_helper"
+	"github.com/mhkarimi1383/pg_pro/types"
+)
+
+// queryInfo is what we know about a query after parsing it, it is computed
+// once per query (or per prepared statement)
+type queryInfo struct {
+	query string
+	// normalized is the canonical form of the query used in cache keys
+	normalized string
+	isRead     bool
+	// cacheable is false for queries with non-deterministic results
+	cacheable bool
+	tables    []types.TableAccessInfo
+	// written are tables modified by writes, writesAll is set when they are
+	// unknown (every cached result of the database is invalidated)
+	written   []types.TableInfo
+	writesAll bool
+	// dependencies are all tables that result of a read depends on, used to
+	// invalidate cached results
+	dependencies []types.TableInfo
+	cachePolicy  cache.Policy
+	// variableSets are session variables changed by the query
+	variableSets []types.VariableSet
+	// prepares are statements prepared or deallocated by the query
+	prepares []types.Prepare
+	// sessionState is set when the query leaves state on the server
+	// connection that is not replayed (see types.QueryTraits)
+	sessionState bool
+	// maxReplicaLag is the replication lag tolerated for this query
+	maxReplicaLag time.Duration
+}
+
+// classify parses the query (once) and checks access of the user to every
+// related table, returned errors are meant to be sent to the client
+func (s *session) classify(q string) (*queryInfo, error) {
+	query, err := queryhelper.Parse(q)
+	if err != nil {
+		return nil, err
+	}
+	accessInfo := queryhelper.GetRelatedTables(query)
+	traits := queryhelper.GetQueryTraits(query)
+	if traits.SuperuserOnly && !auth.GetProvider().IsSuperUser(s.username) {
+		return nil, msghelper.SuperuserRequired("COPY to or from a file or a program")
+	}
+	accessInfo = append(accessInfo, traits.Writes...)
+	info := &queryInfo{
+		query:         q,
+		normalized:    q,
+		isRead:        !traits.RequiresMaster,
+		cacheable:     traits.Cacheable,
+		sessionState:  traits.SessionState,
+		tables:        accessInfo,
+		maxReplicaLag: s.maxReplicaLag,
+	}
+	for _, i := range accessInfo {
+		if !auth.GetProvider().CheckAccess(i, s.username) {
+			return nil, msghelper.AccessDenied(i)
+		}
+		if i.AccessMode != types.Select {
+			info.isRead = false
+		}
+	}
+
+	if !info.isRead {
+		info.written, info.writesAll = queryhelper.GetWrittenTables(query)
+	}
+
+	if info.isRead && info.cacheable {
+		info.dependencies = queryhelper.GetDependencies(query)
+		if normalized, err := queryhelper.NormalizeQuery(query); err == nil {
+			info.normalized = normalized
+		}
+		fingerprint := ""
+		if cache.HasFingerprintPolicies() {
+			if fingerprint, err = queryhelper.GetFingerprint(query); err != nil {
+				return nil, err
+			}
+		}
+		info.cachePolicy = cache.PolicyFor(info.dependencies, s.username, fingerprint)
+	} else if info.variableSets, err = queryhelper.GetVariableSets(query); err != nil {
+		return nil, err
+	} else if info.prepares, err = queryhelper.GetPrepares(query); err != nil {
+		return nil, err
+	} else if len(info.variableSets) > 0 || len(info.prepares) > 0 {
+		// session variables are changed on the master connection of the
+		// session, then replayed on every other connection it uses
+		info.isRead = false
+	}
+
+	hints, err := queryhelper.GetHints(query)
+	if err != nil {
+		return nil, err
+	}
+	for _, hint := range hints {
+		switch hint.Name {
+		case "replica":
+			applyReplicaHint(info, hint)
+		case "cache":
+			applyCacheHint(info, hint)
+		}
+	}
+	info.cacheable = info.cacheable && info.cachePolicy.Enabled
+	return info, nil
+}
+
+// applyReplicaHint handles `/* pg_pro:replica max_lag=<seconds> */`
+func applyReplicaHint(info *queryInfo, hint types.QueryHint) {
+	if v, ok := hint.Options["max_lag"]; ok {
+		seconds, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			logger.Warn(
+				"invalid max_lag hint: "+v,
+				zap.String("event", "query_hint"),
+			)
+			return
+		}
+		info.maxReplicaLag = time.Duration(seconds * float64(time.Second))
+	}
+}
+
+// applyCacheHint handles `/* pg_pro:cache ttl=<seconds> enabled=<bool>
+// max_size=<bytes> */`, it overrides the configured cache policies
+func applyCacheHint(info *queryInfo, hint types.QueryHint) {
+	for option, v := range hint.Options {
+		var err error
+		switch option {
+		case "ttl":
+			var seconds float64
+			if seconds, err = strconv.ParseFloat(v, 64); err == nil {
+				info.cachePolicy.TTL = time.Duration(seconds * float64(time.Second))
+			}
+		case "enabled":
+			info.cachePolicy.Enabled, err = strconv.ParseBool(v)
+		case "max_size":
+			info.cachePolicy.MaxResultSize, err = strconv.Atoi(v)
+		default:
+			err = errors.New("unknown option")
+		}
+		if err != nil {
+			logger.Warn(
+				"invalid cache hint: "+option+"="+v,
+				zap.String("event", "query_hint"),
+			)
+		}
+	}
+}
+
+// stricterLag returns the smaller lag limit, zero means no limit
+func stricterLag(a, b time.Duration) time.Duration {
+	if a <= 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+func (s *session) handleQuery(msg *pgproto3.Query) error {
+	// simple query protocol destroys the unnamed statement and portal
+	s.dropStatement("")
+
+	info, err := s.classify(msg.String)
+	if err != nil {
+		return s.queryFailed(err)
+	}
+
+	if info.isRead && s.txStatus == 'I' && !s.sessionLocal {
+		return s.runRead(msg, info)
+	}
+
+	server, err := s.acquireServer()
+	if err != nil {
+		return s.queryFailed(err)
+	}
+	if !info.isRead {
+		s.startWrite(info)
+	}
+	if err := s.execute(server, msg, nil); err != nil {
+		return err
+	}
+	s.trackWrite()
+	s.invalidateCache()
+	s.applySettings()
+	return nil
+}
+
+// runRead serves read only queries outside of transactions from the cache or
+// from one of the replicas
+func (s *session) runRead(msg *pgproto3.Query, info *queryInfo) error {
+	req, fresh := s.readRequirements(info.maxReplicaLag)
+	key := s.cacheKey(info, nil, nil)
+	var flight *cache.Flight
+	if !fresh && info.cacheable {
+		query := *msg
+		served, f, err := s.cachedRead(key, info, []pgproto3.FrontendMessage{&query}, func(result *types.QueryResult) error {
+			return s.sendResult(result, false, false)
+		})
+		if served || err != nil {
+			return err
+		}
+		flight = f
+	}
+	// result is shared with identical reads waiting for this one
+	var shared *types.QueryResult
+	if flight != nil {
+		defer func() { flight.Finish(shared) }()
+	}
+
+	server, lsn, dirty, err := s.acquireReplica(req)
+	if err != nil {
+		return s.queryFailed(err)
+	}
+	defer releaseServerConn(server, dirty)
+
+	startedAt := time.Now()
+	var collector *resultCollector
+	if info.cacheable {
+		collector = newResultCollector(info.cachePolicy.MaxResultSize)
+	}
+	if err := s.execute(server, msg, collector); err != nil {
+		return err
+	}
+	s.applySettings()
+	if collector != nil && collector.cacheable() {
+		shared = &collector.result
+		if err := cache.Set(key, &collector.result, info.cachePolicy, info.dependencies, startedAt, lsn); err != nil {
+			logger.Warn(err.Error(), zap.String("event", "cache_set"))
+		}
+	}
+	return nil
+}
+
+// invalidationPending tells if writes of the session invalidate any cached
+// result
+func (s *session) invalidationPending() bool {
+	return len(s.pendingInvalidations) > 0 || s.pendingDatabaseInvalidation
+}
+
+// startWrite records a write that is sent to the master, its tables are
+// invalidated when it is done
+func (s *session) startWrite(info *queryInfo) {
+	s.pendingWrite = true
+	s.pendingInvalidations = append(s.pendingInvalidations, info.written...)
+	s.pendingDatabaseInvalidation = s.pendingDatabaseInvalidation || info.writesAll
+	s.trackSettings(info)
+}
+
+// invalidateCache removes cached results depending on tables written by the
+// session, it is called after trackWrite so writes are only considered when
+// they are done (or rolled back)
+func (s *session) invalidateCache() {
+	if !s.invalidationPending() || s.txStatus != 'I' {
+		return
+	}
+	tables := s.pendingInvalidations
+	database := s.pendingDatabaseInvalidation
+	s.pendingInvalidations = nil
+	s.pendingDatabaseInvalidation = false
+	lsn := s.lastWriteLSN
+	if lsn == math.MaxUint64 {
+		// LSN of the write is unknown, only reads that started before now
+		// are not cached
+		lsn = 0
+	}
+	if database {
+		cache.InvalidateDatabase(s.route.Database(), lsn)
+	} else if err := cache.Invalidate(tables, lsn); err != nil {
+		logger.Warn(err.Error(), zap.String("event", "cache_invalidate"))
+	}
+}
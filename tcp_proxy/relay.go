@@ -0,0 +1,279 @@
+package tcpproxy
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+
+	msghelper "github.com/mhkarimi1383/pg_pro/msg_helper"
+	"github.com/mhkarimi1383/pg_pro/types"
+)
+
+// streamFlushSize is the amount of relayed rows (in bytes) that is flushed
+// to the client without waiting for the end of the result
+const streamFlushSize = 64 * 1024
+
+// resultCollector copies the result of a single statement out of the relayed
+// messages, so it could be cached. Values are never decoded, rows are kept as
+// the server sent them in the formats the client asked for in Bind (result
+// formats are part of cache keys), so cached results are byte-identical to
+// the ones of postgres, numerics and binary values included
+type resultCollector struct {
+	result      types.QueryResult
+	described   bool
+	completions int
+	failed      bool
+	// limit is the maximum size of collected rows (in bytes), collecting is
+	// abandoned when the result gets bigger, 0 means no limit
+	limit int
+	size  int
+}
+
+func newResultCollector(limit int) *resultCollector {
+	return &resultCollector{limit: limit}
+}
+
+func (c *resultCollector) collect(msg pgproto3.BackendMessage) {
+	switch msg := msg.(type) {
+	case *pgproto3.RowDescription:
+		c.described = true
+		for _, field := range msg.Fields {
+			field.Name = append([]byte{}, field.Name...)
+			c.result.Fields = append(c.result.Fields, field)
+		}
+	case *pgproto3.DataRow:
+		if c.failed {
+			return
+		}
+		c.size += rowSize(msg)
+		if c.limit > 0 && c.size > c.limit {
+			// result is too big to be cached
+			c.failed = true
+			c.result.DataRows = nil
+			return
+		}
+		c.result.DataRows = append(c.result.DataRows, pgproto3.DataRow{
+			Values: copyValues(msg.Values),
+		})
+	case *pgproto3.CommandComplete:
+		c.completions++
+		c.result.CommandTag = append([]byte{}, msg.CommandTag...)
+	case *pgproto3.ErrorResponse, *pgproto3.EmptyQueryResponse,
+		*pgproto3.CopyInResponse, *pgproto3.CopyOutResponse, *pgproto3.CopyBothResponse:
+		c.failed = true
+	}
+}
+
+func (c *resultCollector) cacheable() bool {
+	return !c.failed && c.described && c.completions == 1
+}
+
+// execute sends a single message to the server and relays the result
+func (s *session) execute(server *pgxpool.Conn, msg pgproto3.FrontendMessage, collector *resultCollector) error {
+	s.setRunning(server)
+	defer s.setRunning(nil)
+	frontend := server.Conn().PgConn().Frontend()
+	frontend.Send(msg)
+	if err := frontend.Flush(); err != nil {
+		closeServer(server)
+		return errors.Wrap(err, "sending message to server")
+	}
+	return s.relay(server, collector, false)
+}
+
+// closeServer closes a server connection that is left in the middle of a
+// message exchange, so its unread messages never reach another client
+func closeServer(server *pgxpool.Conn) {
+	_ = server.Conn().Close(context.Background())
+}
+
+// relay forwards server messages to the client until the server becomes ready
+// for query, collector is optional and extended tells if the messages were
+// sent using the extended protocol, server is closed when relaying fails
+func (s *session) relay(server *pgxpool.Conn, collector *resultCollector, extended bool) (err error) {
+	defer func() {
+		if err != nil {
+			closeServer(server)
+		}
+	}()
+	for {
+		s.sendSynthetic()
+		msg, err := s.receive(server)
+		if err != nil {
+			return err
+		}
+		if msg = s.stepDone(server, msg); msg == nil {
+			continue
+		}
+		if collector != nil {
+			collector.collect(msg)
+		}
+		if _, ok := msg.(*pgproto3.ErrorResponse); ok {
+			s.relayFailed = true
+		}
+		if err := s.forward(msg); err != nil {
+			return err
+		}
+		if _, ok := msg.(*pgproto3.CopyInResponse); ok {
+			if err := s.copyIn(server, extended); err != nil {
+				return err
+			}
+		}
+		if rfq, ok := msg.(*pgproto3.ReadyForQuery); ok {
+			s.txStatus = rfq.TxStatus
+			if s.txStatus == 'I' {
+				// portals are destroyed at the end of every transaction
+				s.portals = map[string]*portal{}
+			}
+			return s.backend.Flush()
+		}
+	}
+}
+
+// relayResponses forwards responses of the planned extended protocol
+// messages to the client, it is used when the client asks for results
+// without a Sync, server is closed when relaying fails
+func (s *session) relayResponses(server *pgxpool.Conn) (err error) {
+	defer func() {
+		if err != nil {
+			closeServer(server)
+		}
+	}()
+	for s.expectsResponses() {
+		s.sendSynthetic()
+		msg, err := s.receive(server)
+		if err != nil {
+			return err
+		}
+		if msg = s.stepDone(server, msg); msg == nil {
+			continue
+		}
+		if err := s.forward(msg); err != nil {
+			return err
+		}
+		switch msg.(type) {
+		case *pgproto3.CopyInResponse:
+			// the Sync following the data would be handled as a new batch
+			if err := s.copyIn(server, false); err != nil {
+				return err
+			}
+		case *pgproto3.ErrorResponse:
+			s.relayFailed = true
+		}
+	}
+	s.sendSynthetic()
+	return s.backend.Flush()
+}
+
+// copyIn relays data of `COPY ... FROM STDIN` from the client to the server
+// until the client ends it, server ignores Sync messages while copying, so
+// in extended protocol the Sync following the data is relayed too
+func (s *session) copyIn(server *pgxpool.Conn, extended bool) error {
+	if err := s.backend.Flush(); err != nil {
+		return errors.Wrap(err, "sending copy in response")
+	}
+	frontend := server.Conn().PgConn().Frontend()
+	done := false
+	unflushed := 0
+	for {
+		msg, err := s.backend.Receive()
+		if err == nil {
+			if _, ok := msg.(*pgproto3.Terminate); ok {
+				err = errors.New("client terminated the connection")
+			}
+		}
+		if err != nil {
+			// server is left in copy mode, so the connection could not be reused
+			closeServer(server)
+			return errors.Wrap(err, "receive copy data")
+		}
+		frontend.Send(msg)
+		switch msg := msg.(type) {
+		case *pgproto3.CopyData:
+			unflushed += len(msg.Data)
+		case *pgproto3.CopyDone, *pgproto3.CopyFail:
+			done = true
+		}
+		_, synced := msg.(*pgproto3.Sync)
+		if done && (synced || !extended) {
+			return errors.Wrap(frontend.Flush(), "sending copy data to server")
+		}
+		if unflushed >= streamFlushSize {
+			unflushed = 0
+			if err := frontend.Flush(); err != nil {
+				return errors.Wrap(err, "sending copy data to server")
+			}
+		}
+	}
+}
+
+// forward sends a server message to the client, rows are flushed while they
+// are relayed, so big results are never buffered completely, ParameterStatus
+// messages are only sent when the value is changed for the client
+func (s *session) forward(msg pgproto3.BackendMessage) error {
+	if status, ok := msg.(*pgproto3.ParameterStatus); ok && !s.parameterChanged(status) {
+		return nil
+	}
+	s.backend.Send(msg)
+	switch msg := msg.(type) {
+	case *pgproto3.DataRow:
+		s.unflushed += rowSize(msg)
+	case *pgproto3.CopyData:
+		s.unflushed += len(msg.Data)
+	case *pgproto3.CommandComplete:
+		s.rolledBack = string(msg.CommandTag) == "ROLLBACK"
+		return nil
+	default:
+		return nil
+	}
+	if s.unflushed < streamFlushSize {
+		return nil
+	}
+	s.unflushed = 0
+	return s.backend.Flush()
+}
+
+func rowSize(row *pgproto3.DataRow) (size int) {
+	for _, value := range row.Values {
+		size += 4 + len(value)
+	}
+	return
+}
+
+// receive reads the next message of the server, fatal errors are sent to the
+// client before returning
+func (s *session) receive(server *pgxpool.Conn) (pgproto3.BackendMessage, error) {
+	msg, err := server.Conn().PgConn().ReceiveMessage(context.Background())
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			s.backend.Send(msghelper.ErrorResponse(pgErr))
+			if flushErr := s.backend.Flush(); flushErr != nil {
+				return nil, flushErr
+			}
+		}
+		return nil, errors.Wrap(err, "receive server message")
+	}
+	return msg, nil
+}
+
+// sendResult sends a cached result to the client, parsed and bound tell if
+// the result is for an extended protocol batch starting with Parse and Bind
+func (s *session) sendResult(result *types.QueryResult, parsed, bound bool) error {
+	if parsed {
+		s.backend.Send(&pgproto3.ParseComplete{})
+	}
+	if bound {
+		s.backend.Send(&pgproto3.BindComplete{})
+	}
+	s.backend.Send(&result.RowDescription)
+	for i := range result.DataRows {
+		s.backend.Send(&result.DataRows[i])
+	}
+	s.backend.Send(&pgproto3.CommandComplete{CommandTag: result.CommandTag})
+	s.backend.Send(&pgproto3.ReadyForQuery{TxStatus: s.txStatus})
+	return s.backend.Flush()
+}
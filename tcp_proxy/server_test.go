@@ -0,0 +1,421 @@
+package tcpproxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+
+	_ "github.com/mhkarimi1383/pg_pro/config/configtest"
+)
+
+// fakeServerAddress is where sources of config/testdata/config.yaml are
+const fakeServerAddress = "127.0.0.1:54329"
+
+// fake is the postgres server of every source in tests
+var fake = &fakeServer{results: map[string]fakeResult{}}
+
+func TestMain(m *testing.M) {
+	listener, err := net.Listen("tcp", fakeServerAddress)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fake.setResult("SELECT pg_current_wal_lsn()::text", fakeResult{
+		fields: []string{"pg_current_wal_lsn"},
+		rows:   [][]string{{"0/16B3748"}},
+	})
+	// failing Parse of messages rejected by pg_pro
+	fake.setResult("pg_pro_rejected", fakeResult{err: "42601"})
+	go fake.serve(listener)
+
+	code := m.Run()
+	listener.Close()
+	os.Exit(code)
+}
+
+// fakeResult is what the fake server returns for a statement
+type fakeResult struct {
+	// fields are names of text columns, results without fields have no
+	// RowDescription (NoData)
+	fields []string
+	rows   [][]string
+	// binary are values of rows in binary format, used for columns that
+	// are asked in binary format
+	binary [][]string
+	tag    string
+	// err is the code of the error returned instead of the result, Parse
+	// of the statement fails too
+	err string
+	// copyIn starts `COPY ... FROM STDIN`
+	copyIn bool
+}
+
+// fakeServer is a minimal postgres server, it answers statements using the
+// results set by tests (or a default one) and records every message it
+// receives
+type fakeServer struct {
+	lock     sync.Mutex
+	results  map[string]fakeResult
+	messages []pgproto3.FrontendMessage
+	copied   []string
+}
+
+func (f *fakeServer) setResult(query string, result fakeResult) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.results[query] = result
+}
+
+// result returns the result of a statement, statements without a result
+// set by tests succeed with an empty one
+func (f *fakeServer) result(query string) fakeResult {
+	f.lock.Lock()
+	result, ok := f.results[query]
+	f.lock.Unlock()
+	if ok {
+		if result.tag == "" {
+			result.tag = fmt.Sprintf("SELECT %v", len(result.rows))
+		}
+		return result
+	}
+	command := strings.ToUpper(strings.SplitN(query, " ", 2)[0])
+	switch command {
+	case "SELECT":
+		return fakeResult{fields: []string{"?column?"}, tag: "SELECT 0"}
+	case "INSERT":
+		return fakeResult{tag: "INSERT 0 1"}
+	case "DISCARD":
+		return fakeResult{tag: "DISCARD ALL"}
+	}
+	return fakeResult{tag: command}
+}
+
+// received returns messages received by the server, filter selects them
+func (f *fakeServer) received(filter func(pgproto3.FrontendMessage) bool) (messages []pgproto3.FrontendMessage) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, msg := range f.messages {
+		if filter(msg) {
+			messages = append(messages, msg)
+		}
+	}
+	return
+}
+
+// copiedData returns rows received by `COPY ... FROM STDIN` statements
+func (f *fakeServer) copiedData() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string{}, f.copied...)
+}
+
+func (f *fakeServer) record(msg pgproto3.FrontendMessage) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.messages = append(f.messages, copyMessage(msg))
+	if data, ok := msg.(*pgproto3.CopyData); ok {
+		f.copied = append(f.copied, string(data.Data))
+	}
+}
+
+func (f *fakeServer) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeServer) handle(conn net.Conn) {
+	defer conn.Close()
+	c := &fakeConn{
+		server:     f,
+		backend:    pgproto3.NewBackend(conn, conn),
+		txStatus:   'I',
+		statements: map[string]string{},
+		portals:    map[string]fakePortal{},
+	}
+	if err := c.startup(conn); err != nil {
+		return
+	}
+	for {
+		msg, err := c.backend.Receive()
+		if err != nil {
+			return
+		}
+		f.record(msg)
+		if _, ok := msg.(*pgproto3.Terminate); ok {
+			return
+		}
+		if err := c.handle(msg); err != nil {
+			return
+		}
+	}
+}
+
+// fakeConn is a connection of the fake server
+type fakeConn struct {
+	server   *fakeServer
+	backend  *pgproto3.Backend
+	txStatus byte
+	// failed is set when an extended protocol message fails, messages are
+	// ignored until Sync
+	failed     bool
+	statements map[string]string
+	portals    map[string]fakePortal
+}
+
+type fakePortal struct {
+	query   string
+	formats []int16
+}
+
+func (c *fakeConn) startup(conn net.Conn) error {
+	msg, err := c.backend.ReceiveStartupMessage()
+	if err != nil {
+		return err
+	}
+	if _, ok := msg.(*pgproto3.SSLRequest); ok {
+		if _, err := conn.Write([]byte("N")); err != nil {
+			return err
+		}
+		return c.startup(conn)
+	}
+	if _, ok := msg.(*pgproto3.StartupMessage); !ok {
+		return fmt.Errorf("unexpected startup message %T", msg)
+	}
+	c.backend.Send(&pgproto3.AuthenticationOk{})
+	for name, value := range map[string]string{
+		"server_version":              "15.1",
+		"server_encoding":             "UTF8",
+		"client_encoding":             "UTF8",
+		"DateStyle":                   "ISO, MDY",
+		"TimeZone":                    "UTC",
+		"integer_datetimes":           "on",
+		"standard_conforming_strings": "on",
+	} {
+		c.backend.Send(&pgproto3.ParameterStatus{Name: name, Value: value})
+	}
+	c.backend.Send(&pgproto3.BackendKeyData{ProcessID: 1, SecretKey: 1})
+	c.backend.Send(&pgproto3.ReadyForQuery{TxStatus: c.txStatus})
+	return c.backend.Flush()
+}
+
+func (c *fakeConn) handle(msg pgproto3.FrontendMessage) error {
+	switch msg := msg.(type) {
+	case *pgproto3.Query:
+		return c.query(msg.String)
+	case *pgproto3.Sync:
+		c.failed = false
+		c.backend.Send(&pgproto3.ReadyForQuery{TxStatus: c.txStatus})
+		return c.backend.Flush()
+	case *pgproto3.Flush:
+		return c.backend.Flush()
+	}
+	if c.failed {
+		return nil
+	}
+
+	switch msg := msg.(type) {
+	case *pgproto3.Parse:
+		if _, ok := c.statements[msg.Name]; ok && msg.Name != "" {
+			c.fail("42P05") // duplicate_prepared_statement
+		} else if result := c.server.result(msg.Query); result.err != "" {
+			c.fail(result.err)
+		} else {
+			c.statements[msg.Name] = msg.Query
+			c.backend.Send(&pgproto3.ParseComplete{})
+		}
+	case *pgproto3.Bind:
+		query, ok := c.statements[msg.PreparedStatement]
+		if !ok {
+			c.fail("26000") // invalid_sql_statement_name
+			return nil
+		}
+		c.portals[msg.DestinationPortal] = fakePortal{
+			query:   query,
+			formats: append([]int16{}, msg.ResultFormatCodes...),
+		}
+		c.backend.Send(&pgproto3.BindComplete{})
+	case *pgproto3.Describe:
+		if msg.ObjectType == 'S' {
+			query, ok := c.statements[msg.Name]
+			if !ok {
+				c.fail("26000") // invalid_sql_statement_name
+				return nil
+			}
+			c.backend.Send(&pgproto3.ParameterDescription{})
+			c.describe(c.server.result(query), nil)
+			return nil
+		}
+		p, ok := c.portals[msg.Name]
+		if !ok {
+			c.fail("34000") // invalid_cursor_name
+			return nil
+		}
+		c.describe(c.server.result(p.query), p.formats)
+	case *pgproto3.Execute:
+		p, ok := c.portals[msg.Portal]
+		if !ok {
+			c.fail("34000") // invalid_cursor_name
+			return nil
+		}
+		return c.execute(p.query, p.formats)
+	case *pgproto3.Close:
+		if msg.ObjectType == 'S' {
+			delete(c.statements, msg.Name)
+		} else {
+			delete(c.portals, msg.Name)
+		}
+		c.backend.Send(&pgproto3.CloseComplete{})
+	}
+	return nil
+}
+
+// query runs statements of the simple query protocol
+func (c *fakeConn) query(query string) error {
+	statements := 0
+	for _, statement := range strings.Split(query, ";") {
+		if statement = strings.TrimSpace(statement); statement == "" {
+			continue
+		}
+		statements++
+		result := c.server.result(statement)
+		if result.err == "" && result.fields != nil {
+			c.describe(result, nil)
+		}
+		if err := c.execute(statement, nil); err != nil {
+			return err
+		}
+		if c.failed {
+			break
+		}
+	}
+	if statements == 0 {
+		c.backend.Send(&pgproto3.EmptyQueryResponse{})
+	}
+	c.failed = false
+	c.backend.Send(&pgproto3.ReadyForQuery{TxStatus: c.txStatus})
+	return c.backend.Flush()
+}
+
+// describe sends RowDescription (or NoData) of a result
+func (c *fakeConn) describe(result fakeResult, formats []int16) {
+	if result.fields == nil {
+		c.backend.Send(&pgproto3.NoData{})
+		return
+	}
+	description := &pgproto3.RowDescription{}
+	for i, name := range result.fields {
+		description.Fields = append(description.Fields, pgproto3.FieldDescription{
+			Name:         []byte(name),
+			DataTypeOID:  25, // text
+			DataTypeSize: -1,
+			TypeModifier: -1,
+			Format:       columnFormat(formats, i),
+		})
+	}
+	c.backend.Send(description)
+}
+
+// columnFormat returns the format of a column asked for in Bind
+func columnFormat(formats []int16, column int) int16 {
+	if len(formats) == 1 {
+		return formats[0]
+	}
+	if column < len(formats) {
+		return formats[column]
+	}
+	return 0
+}
+
+// execute sends rows of a statement in the formats of the portal and tracks
+// the transaction status
+func (c *fakeConn) execute(query string, formats []int16) error {
+	result := c.server.result(query)
+	if result.err != "" {
+		c.fail(result.err)
+		return nil
+	}
+	if result.copyIn {
+		return c.copyIn()
+	}
+	for r, row := range result.rows {
+		values := make([][]byte, len(row))
+		for i, value := range row {
+			if columnFormat(formats, i) == 1 {
+				value = result.binary[r][i]
+			}
+			values[i] = []byte(value)
+		}
+		c.backend.Send(&pgproto3.DataRow{Values: values})
+	}
+	c.backend.Send(&pgproto3.CommandComplete{CommandTag: []byte(result.tag)})
+	switch result.tag {
+	case "BEGIN":
+		c.txStatus = 'T'
+	case "COMMIT", "ROLLBACK":
+		c.txStatus = 'I'
+	}
+	return nil
+}
+
+// copyIn receives rows of `COPY ... FROM STDIN`, Sync and Flush messages
+// are ignored while copying
+func (c *fakeConn) copyIn() error {
+	c.backend.Send(&pgproto3.CopyInResponse{})
+	if err := c.backend.Flush(); err != nil {
+		return err
+	}
+	rows := 0
+	for {
+		msg, err := c.backend.Receive()
+		if err != nil {
+			return err
+		}
+		c.server.record(msg)
+		switch msg.(type) {
+		case *pgproto3.CopyData:
+			rows++
+		case *pgproto3.CopyDone:
+			c.backend.Send(&pgproto3.CommandComplete{CommandTag: []byte(fmt.Sprintf("COPY %v", rows))})
+			return nil
+		case *pgproto3.CopyFail:
+			c.fail("57014") // query_canceled
+			return nil
+		}
+	}
+}
+
+// fail sends an error, the transaction is aborted and messages of the
+// extended protocol are ignored until Sync
+func (c *fakeConn) fail(code string) {
+	c.backend.Send(&pgproto3.ErrorResponse{
+		Severity: "ERROR",
+		Code:     code,
+		Message:  "fake server error",
+	})
+	c.failed = true
+	if c.txStatus == 'T' {
+		c.txStatus = 'E'
+	}
+}
+
+// copyMessage returns a copy of a message, received messages are only valid
+// until the next one is received
+func copyMessage[M pgproto3.Message](msg M) M {
+	copied := reflect.New(reflect.TypeOf(msg).Elem()).Interface().(M)
+	encoded := msg.Encode(nil)
+	if err := copied.Decode(encoded[5:]); err != nil {
+		panic(err)
+	}
+	return copied
+}
@@ -0,0 +1,400 @@
+package tcpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/mhkarimi1383/pg_pro/auth"
+	"github.com/mhkarimi1383/pg_pro/connection"
+	"github.com/mhkarimi1383/pg_pro/logger"
+	msghelper "github.com/mhkarimi1383/pg_pro/msg_helper"
+	"github.com/mhkarimi1383/pg_pro/types"
+	"github.com/mhkarimi1383/pg_pro/utils"
+)
+
+// session keeps state of a single client connection, every message of the
+// client goes through it before reaching postgres
+type session struct {
+	conn    net.Conn
+	backend *pgproto3.Backend
+	tls     bool
+
+	username string
+	database string
+	// route is the cluster of the database and backend user of the client
+	route connection.Route
+	// cancelKey is the BackendKeyData issued to the client, cancel requests
+	// are forwarded to running which is the server connection that is
+	// running a query of the client
+	cancelKey   cancelKey
+	runningLock sync.Mutex
+	running     *pgconn.PgConn
+
+	// server is the master connection used by the session, it is acquired on
+	// first use and kept according to poolMode
+	server   *pgxpool.Conn
+	poolMode connection.PoolMode
+	// serverDirty is set when session variables of the client are applied
+	// to server, so it is reset before giving it back to the pool
+	serverDirty bool
+	// sessionLocal is set when the client has created objects that only
+	// exist on the master connection of the session (temporary tables,
+	// advisory locks, ...) in session pooling mode, its reads are not sent
+	// to replicas (or served from the cache) anymore
+	sessionLocal bool
+	txStatus     byte
+	// maxReplicaLag is the replication lag tolerated by the user
+	maxReplicaLag time.Duration
+
+	// pendingWrite is set when a write is executed and not committed yet,
+	// lastWriteLSN and lastWriteAt are used for read-your-writes consistency
+	pendingWrite bool
+	lastWriteLSN uint64
+	lastWriteAt  time.Time
+	// pendingInvalidations are tables written by the session, cached results
+	// depending on them are invalidated when the writes are done, every
+	// result of the database is invalidated when pendingDatabaseInvalidation
+	// is set
+	pendingInvalidations        []types.TableInfo
+	pendingDatabaseInvalidation bool
+
+	// settings are session variables changed by the client (keyed by name,
+	// the value is the statement), they are part of cache keys
+	settings        map[string]string
+	pendingSettings []types.VariableSet
+	// txSettings are changes of the current transaction, rolledBack tells if
+	// the last completed command was a ROLLBACK
+	txSettings []types.VariableSet
+	rolledBack bool
+	// parameters are the ParameterStatus values reported to the client
+	parameters map[string]string
+	// relayFailed is set when an error is relayed to the client
+	relayFailed bool
+	// unflushed is the size of rows sent to the client without flushing
+	unflushed int
+
+	// statements and portals created by the client using the extended query
+	// protocol, keyed by their names (empty name is the unnamed one)
+	statements map[string]*preparedStatement
+	portals    map[string]*portal
+	// serverStatements are named statements keyed by their server side names
+	serverStatements map[string]*preparedStatement
+	// plan is what is done with responses of the batch sent to server
+	plan []responseStep
+	// prepares are statements prepared using SQL (keyed by name, the value is
+	// the PREPARE statement), they are replayed like session variables
+	prepares        map[string]string
+	pendingPrepares []types.Prepare
+
+	// batch keeps extended query protocol messages until the client asks for
+	// the results using Sync or Flush
+	batch         []pgproto3.FrontendMessage
+	batchID       uint64
+	batchReadOnly bool
+	batchExecutes int
+	// batchMaxReplicaLag is the strictest lag limit of executed statements
+	batchMaxReplicaLag time.Duration
+	flushed            bool
+	ignoreTillSync     bool
+}
+
+func newSession(conn net.Conn) *session {
+	return &session{
+		conn:             conn,
+		backend:          pgproto3.NewBackend(conn, conn),
+		txStatus:         'I',
+		statements:       map[string]*preparedStatement{},
+		portals:          map[string]*portal{},
+		serverStatements: map[string]*preparedStatement{},
+		prepares:         map[string]string{},
+		settings:         map[string]string{},
+		batchReadOnly:    true,
+	}
+}
+
+func (s *session) close() {
+	s.unregisterCancelKey()
+	if s.server != nil {
+		releaseServerConn(s.server, s.serverDirty)
+	}
+	s.conn.Close()
+}
+
+func (s *session) serve() error {
+	if err := s.startup(); err != nil {
+		if errors.Is(err, errCancelRequest) {
+			return nil
+		}
+		return err
+	}
+
+	for {
+		msg, err := s.backend.Receive()
+		if err != nil {
+			return errors.Wrap(err, "receive client message")
+		}
+
+		logger.Debug(
+			"received message",
+			zap.String("event", "receive"),
+			zap.String("type", utils.GetType(msg)),
+		)
+
+		switch msg := msg.(type) {
+		case *pgproto3.Query:
+			err = s.handleQuery(msg)
+		case *pgproto3.Parse:
+			err = s.handleParse(msg)
+		case *pgproto3.Bind:
+			err = s.handleBind(msg)
+		case *pgproto3.Describe:
+			err = s.handleDescribe(msg)
+		case *pgproto3.Execute:
+			err = s.handleExecute(msg)
+		case *pgproto3.Close:
+			err = s.handleClose(msg)
+		case *pgproto3.Flush:
+			err = s.flushBatch(false)
+		case *pgproto3.Sync:
+			err = s.flushBatch(true)
+		case *pgproto3.CopyData, *pgproto3.CopyDone, *pgproto3.CopyFail:
+			// left over of a COPY that is aborted by the server, postgres drops them too
+		case *pgproto3.Terminate:
+			logger.Info(
+				"received terminate message",
+				zap.String("event", "termination"),
+			)
+			return nil
+		default:
+			logger.Warn(
+				fmt.Sprintf("received unhandled message of type %v", utils.GetType(msg)),
+				zap.String("event", "receive"),
+			)
+			s.backend.Send(&pgproto3.ErrorResponse{
+				Severity: "ERROR",
+				Code:     "0A000", // feature_not_supported
+				Message:  fmt.Sprintf("message type %v is not supported by pg_pro", utils.GetType(msg)),
+			})
+			err = s.backend.Flush()
+		}
+		if err == nil {
+			err = s.releaseServer()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *session) startup() error {
+	startupMsg, err := s.backend.ReceiveStartupMessage()
+	if err != nil {
+		return err
+	}
+
+	logger.Info(
+		"received startup message",
+		zap.String("event", "new connection"),
+	)
+
+	switch msg := startupMsg.(type) {
+	case *pgproto3.StartupMessage:
+		if tlsRequired && !s.tls {
+			s.backend.Send(&pgproto3.ErrorResponse{
+				Severity: "FATAL",
+				Code:     "28000", // invalid_authorization_specification
+				Message:  "pg_pro only accepts TLS connections",
+			})
+			if err := s.backend.Flush(); err != nil {
+				return err
+			}
+			return errors.New("client is not using TLS")
+		}
+		return s.authenticate(msg)
+	case *pgproto3.SSLRequest:
+		if tlsConfig == nil || s.tls {
+			if _, err = s.conn.Write([]byte("N")); err != nil {
+				return errors.Wrap(err, "sending deny SSL request to client")
+			}
+			return s.startup()
+		}
+		if _, err = s.conn.Write([]byte("S")); err != nil {
+			return errors.Wrap(err, "sending accept SSL request to client")
+		}
+		tlsConn := tls.Server(s.conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return errors.Wrap(err, "TLS handshake")
+		}
+		s.conn = tlsConn
+		s.backend = pgproto3.NewBackend(tlsConn, tlsConn)
+		s.tls = true
+		return s.startup()
+	case *pgproto3.CancelRequest:
+		return handleCancelRequest(msg)
+	case *pgproto3.GSSEncRequest:
+		if _, err = s.conn.Write([]byte("N")); err != nil {
+			return errors.Wrap(err, "sending deny GSSENC request to client")
+		}
+		return s.startup()
+	default:
+		return errors.Errorf("unknown startup message: %#v", startupMsg)
+	}
+}
+
+func (s *session) authenticate(msg *pgproto3.StartupMessage) error {
+	s.username = msg.Parameters["user"]
+	s.database = msg.Parameters["database"]
+	if s.database == "" {
+		s.database = s.username
+	}
+
+	var err error
+	switch auth.GetProvider().AuthMethod(s.username) {
+	case types.MD5AuthMethod:
+		err = s.authenticateMD5()
+	default:
+		err = s.authenticateSCRAM()
+	}
+	if errors.Is(err, errAuthFailed) {
+		s.backend.Send(&pgproto3.ErrorResponse{
+			Severity: "FATAL",
+			Code:     "28P01", // invalid_password
+			Message:  fmt.Sprintf("password authentication failed for user %q", s.username),
+		})
+		if flushErr := s.backend.Flush(); flushErr != nil {
+			return flushErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	logger.Debug(
+		"user logged in",
+		zap.String("event", "authentication"),
+		zap.String("user", s.username),
+	)
+
+	if s.route, err = connection.RouteFor(s.database, s.username); err != nil {
+		return s.startupFailed(err)
+	}
+	s.poolMode = s.route.PoolMode()
+	s.maxReplicaLag = s.route.MaxReplicaLag()
+	parameters, err := startupParameters(msg)
+	if err != nil {
+		return s.startupFailed(err)
+	}
+	s.applyStartupParameters(parameters)
+
+	s.backend.Send(&pgproto3.AuthenticationOk{})
+	if err := s.sendParameterStatuses(parameters); err != nil {
+		return s.startupFailed(err)
+	}
+	keyData, err := s.registerCancelKey()
+	if err != nil {
+		return err
+	}
+	s.backend.Send(keyData)
+	s.backend.Send(&pgproto3.ReadyForQuery{TxStatus: s.txStatus})
+	if err := s.backend.Flush(); err != nil {
+		return err
+	}
+	// server used for checking startup parameters
+	return s.releaseServer()
+}
+
+// startupFailed reports an error that ends the startup to the client
+func (s *session) startupFailed(err error) error {
+	s.backend.Send(msghelper.ErrorResponse(err))
+	if flushErr := s.backend.Flush(); flushErr != nil {
+		return flushErr
+	}
+	return err
+}
+
+// acquireServer returns the master connection of the session
+func (s *session) acquireServer() (*pgxpool.Conn, error) {
+	if s.server != nil && s.server.Conn().IsClosed() {
+		s.server.Release()
+		s.server = nil
+	}
+	if s.server == nil {
+		server, err := connection.Acquire(context.Background(), s.route, false)
+		if err != nil {
+			return nil, err
+		}
+		replayed, err := replaySettings(server, s.replayStatements())
+		if err != nil {
+			releaseServerConn(server, replayed)
+			return nil, err
+		}
+		s.server = server
+		s.serverDirty = s.serverDirty || replayed
+	}
+	return s.server, nil
+}
+
+// releaseServer gives back the master connection to the pool when the
+// pooling mode allows it
+func (s *session) releaseServer() error {
+	if s.server == nil || s.poolMode == connection.SessionPoolMode {
+		return nil
+	}
+	if s.txStatus != 'I' && s.poolMode == connection.StatementPoolMode {
+		s.backend.Send(&pgproto3.ErrorResponse{
+			Severity: "FATAL",
+			Code:     "08P01", // protocol_violation
+			Message:  "transaction blocks are not allowed in statement pooling mode",
+		})
+		if err := s.backend.Flush(); err != nil {
+			return err
+		}
+		return errors.New("client started a transaction in statement pooling mode")
+	}
+	if s.txStatus != 'I' || s.flushed || s.needsServer() {
+		return nil
+	}
+	s.dropStatement("")
+	releaseServerConn(s.server, s.serverDirty)
+	s.server = nil
+	s.serverDirty = false
+	return nil
+}
+
+// queryFailed reports an error to the client and finishes the current
+// query cycle, transactions are aborted on the server like the statement has
+// failed there, so they could only be rolled back
+func (s *session) queryFailed(err error) error {
+	s.batch = s.batch[:0]
+	s.dropPending()
+	if s.txStatus == 'T' && s.server != nil && !s.ignoreTillSync {
+		s.batch = append(s.batch, newRejection(err))
+		return s.flushBatch(true)
+	}
+	s.backend.Send(msghelper.ErrorResponse(err))
+	s.backend.Send(&pgproto3.ReadyForQuery{TxStatus: s.txStatus})
+	return s.backend.Flush()
+}
+
+func copyValues(params [][]byte) [][]byte {
+	if params == nil {
+		return nil
+	}
+	result := make([][]byte, len(params))
+	for i, p := range params {
+		if p != nil {
+			result[i] = append([]byte{}, p...)
+		}
+	}
+	return result
+}
@@ -0,0 +1,422 @@
+package tcpproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// dial opens a client connection to a session, sessions are served over
+// net.Pipe and their sources are the fake server
+func dial(user, password, database string) (*pgconn.PgConn, error) {
+	config, err := pgconn.ParseConfig(fmt.Sprintf("postgres://%v:%v@127.0.0.1/%v?sslmode=disable", user, password, database))
+	if err != nil {
+		return nil, err
+	}
+	config.DialFunc = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		client, proxy := net.Pipe()
+		go handleClient(proxy)
+		return client, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return pgconn.ConnectConfig(ctx, config)
+}
+
+// connect opens a client connection that is closed at the end of the test
+func connect(t *testing.T, user, password, database string) *pgconn.PgConn {
+	t.Helper()
+	conn, err := dial(user, password, database)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close(context.Background()) })
+	return conn
+}
+
+// send sends messages of the client without waiting for responses
+func send(t *testing.T, conn *pgconn.PgConn, messages ...pgproto3.FrontendMessage) {
+	t.Helper()
+	frontend := conn.Frontend()
+	for _, msg := range messages {
+		frontend.Send(msg)
+	}
+	if err := frontend.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receive returns responses until (and including) the one matching last
+func receive(t *testing.T, conn *pgconn.PgConn, last func(pgproto3.BackendMessage) bool) (responses []pgproto3.BackendMessage) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		msg, err := conn.ReceiveMessage(ctx)
+		if err != nil {
+			t.Fatalf("receive: %v (after %v)", err, messageTypes(responses))
+		}
+		msg = copyMessage(msg)
+		responses = append(responses, msg)
+		if last(msg) {
+			return
+		}
+	}
+}
+
+func readyForQuery(msg pgproto3.BackendMessage) bool {
+	_, ok := msg.(*pgproto3.ReadyForQuery)
+	return ok
+}
+
+// exchange sends messages and returns responses until ReadyForQuery
+func exchange(t *testing.T, conn *pgconn.PgConn, messages ...pgproto3.FrontendMessage) []pgproto3.BackendMessage {
+	t.Helper()
+	send(t, conn, messages...)
+	return receive(t, conn, readyForQuery)
+}
+
+// messageTypes returns type names of messages, e.g. ParseComplete
+func messageTypes(messages []pgproto3.BackendMessage) []string {
+	names := make([]string, len(messages))
+	for i, msg := range messages {
+		names[i] = strings.TrimPrefix(fmt.Sprintf("%T", msg), "*pgproto3.")
+	}
+	return names
+}
+
+func checkTypes(t *testing.T, responses []pgproto3.BackendMessage, want ...string) {
+	t.Helper()
+	if got := messageTypes(responses); !reflect.DeepEqual(got, want) {
+		t.Fatalf("responses = %v, want %v (%v)", got, want, errorMessage(responses))
+	}
+}
+
+// errorCode returns code of the ErrorResponse of responses
+func errorCode(responses []pgproto3.BackendMessage) string {
+	for _, msg := range responses {
+		if e, ok := msg.(*pgproto3.ErrorResponse); ok {
+			return e.Code
+		}
+	}
+	return ""
+}
+
+// parsesOf returns Parse messages of a query received by the fake server
+func parsesOf(query string) []pgproto3.FrontendMessage {
+	return fake.received(func(msg pgproto3.FrontendMessage) bool {
+		parse, ok := msg.(*pgproto3.Parse)
+		return ok && parse.Query == query
+	})
+}
+
+func TestSessionNamedStatements(t *testing.T) {
+	const query = "SELECT name FROM countries WHERE id = $1"
+	fake.setResult(query, fakeResult{fields: []string{"name"}, rows: [][]string{{"Iran"}}})
+	conn := connect(t, "user", "pencil", "postgres")
+	// statements stay on the master connection of the transaction
+	checkTypes(t, exchange(t, conn, &pgproto3.Query{String: "BEGIN"}), "CommandComplete", "ReadyForQuery")
+
+	// the server connection could have the statement of an earlier client
+	before := len(parsesOf(query))
+	checkTypes(t, exchange(t, conn, &pgproto3.Parse{Name: "s1", Query: query}, &pgproto3.Sync{}),
+		"ParseComplete", "ReadyForQuery")
+	for _, parse := range parsesOf(query)[before:] {
+		if name := parse.(*pgproto3.Parse).Name; !strings.HasPrefix(name, "pg_pro_") {
+			t.Fatalf("server received statement %q, want a name issued by pg_pro", name)
+		}
+	}
+
+	responses := exchange(t, conn,
+		&pgproto3.Bind{PreparedStatement: "s1", Parameters: [][]byte{[]byte("1")}},
+		&pgproto3.Describe{ObjectType: 'P'},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	)
+	checkTypes(t, responses, "BindComplete", "RowDescription", "DataRow", "CommandComplete", "ReadyForQuery")
+	if row := responses[2].(*pgproto3.DataRow); string(row.Values[0]) != "Iran" {
+		t.Fatalf("row = %q, want Iran", row.Values)
+	}
+
+	// statement is kept on the server for other clients, so closing and
+	// preparing it again are answered by pg_pro
+	checkTypes(t, exchange(t, conn, &pgproto3.Close{ObjectType: 'S', Name: "s1"}, &pgproto3.Sync{}),
+		"CloseComplete", "ReadyForQuery")
+	checkTypes(t, exchange(t, conn, &pgproto3.Parse{Name: "s1", Query: query}, &pgproto3.Sync{}),
+		"ParseComplete", "ReadyForQuery")
+	if parses := len(parsesOf(query)) - before; parses > 1 {
+		t.Fatalf("server received %v Parse messages, want the statement prepared once", parses)
+	}
+	closes := fake.received(func(msg pgproto3.FrontendMessage) bool {
+		close, ok := msg.(*pgproto3.Close)
+		return ok && close.ObjectType == 'S'
+	})
+	if len(closes) != 0 {
+		t.Fatalf("server received %v Close messages, want none", len(closes))
+	}
+
+	// statements of a failed Parse are not created
+	const failing = "SELECT name FROM countries WHERE missing = $1"
+	fake.setResult(failing, fakeResult{err: "42703"})
+	responses = exchange(t, conn,
+		&pgproto3.Parse{Name: "s2", Query: failing},
+		&pgproto3.Bind{PreparedStatement: "s2"},
+		&pgproto3.Sync{},
+	)
+	checkTypes(t, responses, "ErrorResponse", "ReadyForQuery")
+	if code := errorCode(responses); code != "42703" {
+		t.Fatalf("error code = %v, want 42703", code)
+	}
+	checkTypes(t, exchange(t, conn, &pgproto3.Query{String: "ROLLBACK"}), "CommandComplete", "ReadyForQuery")
+	responses = exchange(t, conn, &pgproto3.Bind{PreparedStatement: "s2"}, &pgproto3.Sync{})
+	if code := errorCode(responses); code != "26000" {
+		t.Fatalf("error code = %v, want 26000", code)
+	}
+}
+
+func TestSessionRejection(t *testing.T) {
+	const query = "SELECT name FROM countries WHERE code = 'SE'"
+	fake.setResult(query, fakeResult{fields: []string{"name"}, rows: [][]string{{"Sweden"}}})
+	conn := connect(t, "user", "pencil", "postgres")
+	rejected := "pg_pro_rejected"
+
+	t.Run("nothing queued", func(t *testing.T) {
+		before := len(parsesOf(rejected))
+		responses := exchange(t, conn,
+			&pgproto3.Parse{Query: "SELECT * FROM secrets"},
+			&pgproto3.Bind{},
+			&pgproto3.Execute{},
+			&pgproto3.Sync{},
+		)
+		checkTypes(t, responses, "ErrorResponse", "ReadyForQuery")
+		if code := errorCode(responses); code != "42501" {
+			t.Fatalf("error code = %v, want 42501", code)
+		}
+		if len(parsesOf(rejected)) != before {
+			t.Fatal("rejection is sent to the server, want it answered by pg_pro")
+		}
+	})
+
+	t.Run("in transaction", func(t *testing.T) {
+		checkTypes(t, exchange(t, conn, &pgproto3.Query{String: "BEGIN"}), "CommandComplete", "ReadyForQuery")
+		responses := exchange(t, conn,
+			&pgproto3.Parse{Query: query},
+			&pgproto3.Bind{},
+			&pgproto3.Execute{},
+			&pgproto3.Parse{Query: "SELECT * FROM secrets"},
+			&pgproto3.Bind{},
+			&pgproto3.Execute{},
+			&pgproto3.Sync{},
+		)
+		// messages before the rejected one are run, then the server fails
+		// in its place, so the transaction is aborted
+		checkTypes(t, responses, "ParseComplete", "BindComplete", "DataRow", "CommandComplete", "ErrorResponse", "ReadyForQuery")
+		if code := errorCode(responses); code != "42501" {
+			t.Fatalf("error code = %v, want 42501 of pg_pro", code)
+		}
+		if status := responses[5].(*pgproto3.ReadyForQuery).TxStatus; status != 'E' {
+			t.Fatalf("transaction status = %c, want E", status)
+		}
+		checkTypes(t, exchange(t, conn, &pgproto3.Query{String: "ROLLBACK"}), "CommandComplete", "ReadyForQuery")
+	})
+}
+
+func TestSessionReleaseServer(t *testing.T) {
+	// pooled database has a single connection in transaction pooling mode
+	first := connect(t, "user", "pencil", "pooled")
+	second := connect(t, "user", "pencil", "pooled")
+	insert := func(value string) *pgproto3.Query {
+		return &pgproto3.Query{String: "INSERT INTO events VALUES ('" + value + "')"}
+	}
+
+	inserts := func() (queries []string) {
+		for _, msg := range fake.received(func(msg pgproto3.FrontendMessage) bool {
+			query, ok := msg.(*pgproto3.Query)
+			return ok && strings.HasPrefix(query.String, "INSERT INTO events")
+		}) {
+			queries = append(queries, msg.(*pgproto3.Query).String)
+		}
+		return
+	}
+	before := len(inserts())
+
+	checkTypes(t, exchange(t, first, insert("first")), "CommandComplete", "ReadyForQuery")
+	// connection is released after the statement
+	checkTypes(t, exchange(t, second, insert("second")), "CommandComplete", "ReadyForQuery")
+
+	// connection is kept until the transaction ends
+	checkTypes(t, exchange(t, first, &pgproto3.Query{String: "BEGIN"}), "CommandComplete", "ReadyForQuery")
+	send(t, second, insert("waiting"))
+	checkTypes(t, exchange(t, first, insert("transaction")), "CommandComplete", "ReadyForQuery")
+	checkTypes(t, exchange(t, first, &pgproto3.Query{String: "COMMIT"}), "CommandComplete", "ReadyForQuery")
+	checkTypes(t, receive(t, second, readyForQuery), "CommandComplete", "ReadyForQuery")
+
+	want := []string{
+		insert("first").String,
+		insert("second").String,
+		insert("transaction").String,
+		insert("waiting").String,
+	}
+	if order := inserts()[before:]; !reflect.DeepEqual(order, want) {
+		t.Fatalf("server received %v, want %v", order, want)
+	}
+}
+
+func TestSessionCopyIn(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		messages func(query string) []pgproto3.FrontendMessage
+	}{
+		{
+			name:  "simple query",
+			query: "COPY events FROM STDIN",
+			messages: func(query string) []pgproto3.FrontendMessage {
+				return []pgproto3.FrontendMessage{&pgproto3.Query{String: query}}
+			},
+		},
+		{
+			name:  "extended query",
+			query: "COPY events (name) FROM STDIN",
+			messages: func(query string) []pgproto3.FrontendMessage {
+				return []pgproto3.FrontendMessage{
+					&pgproto3.Parse{Query: query},
+					&pgproto3.Bind{},
+					&pgproto3.Execute{},
+					&pgproto3.Sync{},
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake.setResult(tt.query, fakeResult{copyIn: true})
+			conn := connect(t, "user", "pencil", "postgres")
+			before := len(fake.copiedData())
+
+			send(t, conn, tt.messages(tt.query)...)
+			receive(t, conn, func(msg pgproto3.BackendMessage) bool {
+				_, ok := msg.(*pgproto3.CopyInResponse)
+				return ok
+			})
+			messages := []pgproto3.FrontendMessage{
+				&pgproto3.CopyData{Data: []byte(tt.name + " 1\n")},
+				&pgproto3.CopyData{Data: []byte(tt.name + " 2\n")},
+				&pgproto3.CopyDone{},
+			}
+			if _, ok := tt.messages(tt.query)[0].(*pgproto3.Parse); ok {
+				messages = append(messages, &pgproto3.Sync{})
+			}
+			responses := exchange(t, conn, messages...)
+			checkTypes(t, responses[len(responses)-2:], "CommandComplete", "ReadyForQuery")
+			if tag := string(responses[len(responses)-2].(*pgproto3.CommandComplete).CommandTag); tag != "COPY 2" {
+				t.Fatalf("command tag = %v, want COPY 2", tag)
+			}
+			want := []string{tt.name + " 1\n", tt.name + " 2\n"}
+			if copied := fake.copiedData()[before:]; !reflect.DeepEqual(copied, want) {
+				t.Fatalf("server received %q, want %q", copied, want)
+			}
+
+			// connection is usable after the copy
+			checkTypes(t, exchange(t, conn, &pgproto3.Query{String: "SELECT 1"}), "RowDescription", "CommandComplete", "ReadyForQuery")
+		})
+	}
+}
+
+func TestSessionCachedExtendedRead(t *testing.T) {
+	const query = "SELECT name FROM countries WHERE code = $1"
+	fake.setResult(query, fakeResult{fields: []string{"name"}, rows: [][]string{{"Iran"}}})
+	conn := connect(t, "user", "pencil", "postgres")
+	// parameters are part of the cache key, results of earlier runs are not
+	// used
+	code := []byte(time.Now().String())
+	read := func() []pgproto3.BackendMessage {
+		return exchange(t, conn,
+			&pgproto3.Parse{Query: query},
+			&pgproto3.Bind{Parameters: [][]byte{code}},
+			&pgproto3.Describe{ObjectType: 'P'},
+			&pgproto3.Execute{},
+			&pgproto3.Sync{},
+		)
+	}
+
+	before := len(parsesOf(query))
+	first := read()
+	checkTypes(t, first, "ParseComplete", "BindComplete", "RowDescription", "DataRow", "CommandComplete", "ReadyForQuery")
+	second := read()
+	if !reflect.DeepEqual(second, first) {
+		t.Fatalf("cached responses = %v, want %v", messageTypes(second), messageTypes(first))
+	}
+	if parses := len(parsesOf(query)) - before; parses != 1 {
+		t.Fatalf("server received %v Parse messages, want 1", parses)
+	}
+}
+
+func errorMessage(responses []pgproto3.BackendMessage) string {
+	for _, msg := range responses {
+		if e, ok := msg.(*pgproto3.ErrorResponse); ok {
+			return e.Message
+		}
+	}
+	return ""
+}
+
+func TestSessionResultFormats(t *testing.T) {
+	const query = "SELECT code, population FROM countries WHERE name = $1"
+	fake.setResult(query, fakeResult{
+		fields: []string{"code", "population"},
+		rows:   [][]string{{"IR", "88550570"}},
+		binary: [][]string{{"IR", "\x05\x47\x30\x2a"}},
+	})
+	conn := connect(t, "user", "pencil", "postgres")
+	name := []byte(time.Now().String())
+
+	tests := []struct {
+		name    string
+		formats []int16
+		want    []string
+	}{
+		{name: "text", want: []string{"IR", "88550570"}},
+		{name: "binary", formats: []int16{1}, want: []string{"IR", "\x05\x47\x30\x2a"}},
+		{name: "per column", formats: []int16{0, 1}, want: []string{"IR", "\x05\x47\x30\x2a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(parsesOf(query))
+			// the second read is served from the cache
+			for i := 0; i < 2; i++ {
+				responses := exchange(t, conn,
+					&pgproto3.Parse{Query: query},
+					&pgproto3.Bind{Parameters: [][]byte{name}, ResultFormatCodes: tt.formats},
+					&pgproto3.Describe{ObjectType: 'P'},
+					&pgproto3.Execute{},
+					&pgproto3.Sync{},
+				)
+				checkTypes(t, responses, "ParseComplete", "BindComplete", "RowDescription", "DataRow", "CommandComplete", "ReadyForQuery")
+				for column, field := range responses[2].(*pgproto3.RowDescription).Fields {
+					if format := columnFormat(tt.formats, column); field.Format != format {
+						t.Fatalf("format of %s = %v, want %v", field.Name, field.Format, format)
+					}
+				}
+				var values []string
+				for _, value := range responses[3].(*pgproto3.DataRow).Values {
+					values = append(values, string(value))
+				}
+				if !reflect.DeepEqual(values, tt.want) {
+					t.Fatalf("values = %q, want %q", values, tt.want)
+				}
+			}
+			// results cached in other formats are not used
+			if parses := len(parsesOf(query)) - before; parses != 1 {
+				t.Fatalf("server received %v Parse messages, want 1", parses)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package tcpproxy
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/mhkarimi1383/pg_pro/cache"
+	"github.com/mhkarimi1383/pg_pro/config"
+	"github.com/mhkarimi1383/pg_pro/connection"
+	"github.com/mhkarimi1383/pg_pro/logger"
+	queryhelper "github.com/mhkarimi1383/pg_pro/query_helper"
+	"github.com/mhkarimi1383/pg_pro/types"
+)
+
+var (
+	// resetQuery runs on server connections that had session variables of a
+	// client before giving them back to the pool
+	resetQuery = "DISCARD ALL"
+	// resetDeallocates is set when resetQuery drops prepared statements too
+	resetDeallocates bool
+)
+
+func init() {
+	if config.Get("pooling.reset_query") != nil {
+		resetQuery = config.GetString("pooling.reset_query")
+	}
+	query, err := queryhelper.Parse(resetQuery)
+	if err != nil {
+		panic(errors.Wrap(err, "parsing reset query"))
+	}
+	prepares, err := queryhelper.GetPrepares(query)
+	if err != nil {
+		panic(errors.Wrap(err, "parsing reset query"))
+	}
+	for _, prepare := range prepares {
+		resetDeallocates = resetDeallocates || prepare.DeallocateAll
+	}
+}
+
+// trackSettings remembers session variables changed by a statement, they are
+// applied when the server reports the statement as successful
+func (s *session) trackSettings(info *queryInfo) {
+	if len(info.variableSets) > 0 || len(info.prepares) > 0 || info.sessionState {
+		// statement runs on the master connection of the session
+		s.serverDirty = true
+	}
+	if info.sessionState && s.poolMode == connection.SessionPoolMode {
+		s.sessionLocal = true
+	}
+	s.pendingSettings = append(s.pendingSettings, info.variableSets...)
+	s.pendingPrepares = append(s.pendingPrepares, info.prepares...)
+}
+
+// applySettings applies (or drops when anything has failed) the pending
+// session variable changes, it is called after the server became ready for
+// query, changes made in a transaction are only applied when it is committed
+func (s *session) applySettings() {
+	failed := s.relayFailed
+	s.relayFailed = false
+	if !failed {
+		s.txSettings = append(s.txSettings, s.pendingSettings...)
+		s.applyPrepares(s.pendingPrepares)
+	}
+	s.pendingSettings = nil
+	s.pendingPrepares = nil
+	if s.txStatus != 'I' {
+		return
+	}
+	sets := s.txSettings
+	s.txSettings = nil
+	if s.rolledBack {
+		return
+	}
+	for _, set := range sets {
+		switch {
+		case set.Local:
+			// only lasts until the end of the transaction
+		case set.ResetAll:
+			s.settings = map[string]string{}
+		case set.Reset:
+			delete(s.settings, set.Name)
+		default:
+			s.settings[set.Name] = set.Statement
+		}
+	}
+}
+
+// cacheKey builds the cache key of a read, bind is nil for simple queries
+func (s *session) cacheKey(info *queryInfo, statement *preparedStatement, bind *pgproto3.Bind) *cache.Key {
+	key := &cache.Key{
+		Query:    info.normalized,
+		Database: s.route.Database(),
+		Scope:    cache.ScopeFor(s.username, info.dependencies),
+		Settings: s.settingStatements(),
+	}
+	if bind != nil {
+		key.ParameterOIDs = statement.parameterOIDs
+		key.ParameterFormats = bind.ParameterFormatCodes
+		key.Parameters = bind.Parameters
+		key.ResultFormats = bind.ResultFormatCodes
+	}
+	return key
+}
+
+// applyPrepares records statements prepared using SQL, unlike session
+// variables they are not rolled back with transactions
+func (s *session) applyPrepares(prepares []types.Prepare) {
+	for _, prepare := range prepares {
+		switch {
+		case prepare.DeallocateAll:
+			s.prepares = map[string]string{}
+			if s.server != nil {
+				// named statements of other clients are gone too
+				forgetStatements(s.server.Conn().PgConn())
+			}
+		case prepare.Deallocate:
+			delete(s.prepares, prepare.Name)
+		default:
+			s.prepares[prepare.Name] = prepare.Statement
+		}
+	}
+}
+
+// replayStatements returns statements that recreate session variables and
+// statements prepared using SQL on the master connection
+func (s *session) replayStatements() []string {
+	statements := s.settingStatements()
+	for _, statement := range s.prepares {
+		statements = append(statements, statement)
+	}
+	return statements
+}
+
+// settingStatements returns statements that recreate session variables of
+// the client
+func (s *session) settingStatements() []string {
+	statements := make([]string, 0, len(s.settings))
+	for _, statement := range s.settings {
+		statements = append(statements, statement)
+	}
+	sort.Strings(statements)
+	return statements
+}
+
+// replaySettings applies session variables of a client to a server
+// connection before it is used for the client, it returns false when there
+// was nothing to apply
+func replaySettings(server *pgxpool.Conn, statements []string) (bool, error) {
+	if len(statements) == 0 {
+		return false, nil
+	}
+	_, err := server.Conn().PgConn().Exec(context.Background(), strings.Join(statements, "; ")).ReadAll()
+	return true, errors.Wrap(err, "replaying session variables")
+}
+
+// releaseServerConn gives back a server connection to the pool, connections
+// that had session variables of a client (dirty) are reset first
+func releaseServerConn(server *pgxpool.Conn, dirty bool) {
+	conn := server.Conn()
+	if dirty && resetQuery != "" && !conn.IsClosed() && conn.PgConn().TxStatus() == 'I' {
+		if _, err := conn.PgConn().Exec(context.Background(), resetQuery).ReadAll(); err != nil {
+			logger.Warn(
+				err.Error(),
+				zap.String("event", "reset_connection"),
+			)
+			// connection is not given to other clients with our settings
+			_ = conn.Close(context.Background())
+			forgetStatements(conn.PgConn())
+		} else if resetDeallocates {
+			forgetStatements(conn.PgConn())
+		}
+	}
+	server.Release()
+}
+
+// acquireReplica gets a replica connection with session variables of the
+// client, it has to be released using releaseServerConn, lsn is what the
+// replica is known to have replayed (see connection.AcquireReplica)
+func (s *session) acquireReplica(req connection.ReadRequirements) (server *pgxpool.Conn, lsn uint64, dirty bool, err error) {
+	server, lsn, err = connection.AcquireReplica(context.Background(), s.route, req)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if dirty, err = replaySettings(server, s.settingStatements()); err != nil {
+		releaseServerConn(server, dirty)
+		return nil, 0, false, err
+	}
+	return server, lsn, dirty, nil
+}
@@ -0,0 +1,311 @@
+package tcpproxy
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"sync"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/mhkarimi1383/pg_pro/config"
+	msghelper "github.com/mhkarimi1383/pg_pro/msg_helper"
+)
+
+// Named statements of clients are prepared on server connections using names
+// issued by pg_pro (derived from the query, parameter types and session
+// variables), so they could be prepared again on whatever connection runs
+// them, every server connection keeps its most recently used statements
+
+// maxServerStatements is the number of statements kept per server connection
+var maxServerStatements = 100
+
+func init() {
+	if config.Get("pooling.max_prepared_statements") != nil {
+		maxServerStatements = config.GetInt("pooling.max_prepared_statements")
+	}
+}
+
+// serverStatements is the LRU list of statements prepared on a server
+// connection, it is only used by the session holding the connection
+type serverStatements struct {
+	elements map[string]*list.Element
+	// order has the most recently used statement at front
+	order *list.List
+}
+
+var (
+	serverStatementsLock   sync.Mutex
+	serverStatementsByConn = map[*pgconn.PgConn]*serverStatements{}
+)
+
+// statementsOf returns statements prepared on a server connection
+func statementsOf(conn *pgconn.PgConn) *serverStatements {
+	serverStatementsLock.Lock()
+	defer serverStatementsLock.Unlock()
+	statements, ok := serverStatementsByConn[conn]
+	if !ok {
+		// forget connections that are closed by the pool
+		for c := range serverStatementsByConn {
+			if c.IsClosed() {
+				delete(serverStatementsByConn, c)
+			}
+		}
+		statements = &serverStatements{elements: map[string]*list.Element{}, order: list.New()}
+		serverStatementsByConn[conn] = statements
+	}
+	return statements
+}
+
+// forgetStatements is called when every statement of a server connection is
+// deallocated (e.g. by `DISCARD ALL`)
+func forgetStatements(conn *pgconn.PgConn) {
+	serverStatementsLock.Lock()
+	defer serverStatementsLock.Unlock()
+	delete(serverStatementsByConn, conn)
+}
+
+// touch marks a statement as recently used, it returns false when the
+// statement is not prepared on the connection
+func (l *serverStatements) touch(name string) bool {
+	element, ok := l.elements[name]
+	if ok {
+		l.order.MoveToFront(element)
+	}
+	return ok
+}
+
+func (l *serverStatements) add(name string) {
+	if !l.touch(name) {
+		l.elements[name] = l.order.PushFront(name)
+	}
+}
+
+func (l *serverStatements) remove(name string) {
+	if element, ok := l.elements[name]; ok {
+		l.order.Remove(element)
+		delete(l.elements, name)
+	}
+}
+
+// evictable returns the least recently used statements that have to be
+// closed to make room for n new ones, statements in use are kept
+func (l *serverStatements) evictable(n int, inUse map[string]bool) (names []string) {
+	excess := l.order.Len() + n - maxServerStatements
+	for element := l.order.Back(); element != nil && len(names) < excess; element = element.Prev() {
+		if name := element.Value.(string); !inUse[name] {
+			names = append(names, name)
+		}
+	}
+	return
+}
+
+// serverStatementName returns the name of a client statement on servers
+func (s *session) serverStatementName(parse *pgproto3.Parse) string {
+	h := sha256.New()
+	h.Write([]byte(parse.Query))
+	h.Write([]byte{0})
+	for _, oid := range parse.ParameterOIDs {
+		_ = binary.Write(h, binary.BigEndian, oid)
+	}
+	for _, statement := range s.settingStatements() {
+		h.Write([]byte(statement))
+		h.Write([]byte{0})
+	}
+	return "pg_pro_" + hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// responseStep tells what is done with the response of a message of the
+// batch, responses are completed by ParseComplete, BindComplete, NoData,
+// RowDescription (of Describe), CommandComplete, EmptyQueryResponse,
+// PortalSuspended or CloseComplete
+type responseStep struct {
+	// synthetic is sent to the client by pg_pro, the message is not sent to
+	// the server
+	synthetic pgproto3.BackendMessage
+	// internal responses are not relayed to the client
+	internal bool
+	// prepared and closed are statements created or closed on the server
+	// connection when the message succeeds
+	prepared string
+	closed   string
+	// parsed is the client statement created by the message
+	parsed *preparedStatement
+	// failure is sent to the client instead of the error of the server
+	failure *pgproto3.ErrorResponse
+}
+
+// rejection is queued in place of a message rejected by pg_pro, it fails on
+// the server (the statement could not be parsed), so the transaction is
+// aborted and later messages are ignored until Sync just like when a
+// statement fails on the server itself
+type rejection struct {
+	*pgproto3.Parse
+	response *pgproto3.ErrorResponse
+}
+
+func newRejection(err error) *rejection {
+	return &rejection{
+		Parse:    &pgproto3.Parse{Name: "pg_pro_rejected", Query: "pg_pro_rejected"},
+		response: msghelper.ErrorResponse(err),
+	}
+}
+
+// planBatch rewrites the batch for a server connection, statements that the
+// connection lacks are prepared before their use and statements it already
+// has are not parsed again, s.plan keeps the responses in order
+func (s *session) planBatch(server *pgxpool.Conn) []pgproto3.FrontendMessage {
+	statements := statementsOf(server.Conn().PgConn())
+	messages := make([]pgproto3.FrontendMessage, 0, len(s.batch))
+	s.plan = s.plan[:0]
+	inUse := map[string]bool{}
+	added := 0
+
+	// present tells if a statement is (or will be) prepared on the server
+	present := func(name string) bool {
+		if inUse[name] {
+			return true
+		}
+		inUse[name] = true
+		return statements.touch(name)
+	}
+	ensure := func(name string) {
+		if name == "" || present(name) {
+			return
+		}
+		statement, ok := s.serverStatements[name]
+		if !ok {
+			return
+		}
+		added++
+		messages = append(messages, statement.parse)
+		s.plan = append(s.plan, responseStep{internal: true, prepared: name})
+	}
+
+	for _, msg := range s.batch {
+		step := responseStep{}
+		switch msg := msg.(type) {
+		case *rejection:
+			messages = append(messages, msg.Parse)
+			s.plan = append(s.plan, responseStep{failure: msg.response})
+			continue
+		case *pgproto3.Parse:
+			step.parsed = s.parsedStatement(msg)
+			if msg.Name != "" {
+				if present(msg.Name) {
+					s.plan = append(s.plan, responseStep{synthetic: &pgproto3.ParseComplete{}, parsed: step.parsed})
+					continue
+				}
+				added++
+				step.prepared = msg.Name
+			}
+		case *pgproto3.Bind:
+			ensure(msg.PreparedStatement)
+		case *pgproto3.Describe:
+			if msg.ObjectType == 'S' {
+				ensure(msg.Name)
+			}
+		case *pgproto3.Close:
+			if msg.ObjectType == 'S' && msg.Name != "" {
+				// statement is kept on the server for other clients
+				s.plan = append(s.plan, responseStep{synthetic: &pgproto3.CloseComplete{}})
+				continue
+			}
+		}
+		messages = append(messages, msg)
+		s.plan = append(s.plan, step)
+	}
+
+	evicted := statements.evictable(added, inUse)
+	if len(evicted) == 0 {
+		return messages
+	}
+	closes := make([]pgproto3.FrontendMessage, 0, len(evicted)+len(messages))
+	steps := make([]responseStep, 0, len(evicted)+len(s.plan))
+	for _, name := range evicted {
+		closes = append(closes, &pgproto3.Close{ObjectType: 'S', Name: name})
+		steps = append(steps, responseStep{internal: true, closed: name})
+	}
+	s.plan = append(steps, s.plan...)
+	return append(closes, messages...)
+}
+
+// parsedStatement returns the client statement of a queued Parse
+func (s *session) parsedStatement(parse *pgproto3.Parse) *preparedStatement {
+	statement := s.serverStatements[parse.Name]
+	if parse.Name == "" {
+		statement = s.statements[""]
+	}
+	if statement == nil || statement.parse != parse {
+		return nil
+	}
+	return statement
+}
+
+// sendSynthetic sends responses of messages that were not sent to the server
+// and precede the next server response
+func (s *session) sendSynthetic() {
+	for len(s.plan) > 0 && s.plan[0].synthetic != nil {
+		if s.plan[0].parsed != nil {
+			s.plan[0].parsed.pending = false
+		}
+		s.backend.Send(s.plan[0].synthetic)
+		s.plan = s.plan[1:]
+	}
+}
+
+// expectsResponses tells if any planned response has to come from the server
+func (s *session) expectsResponses() bool {
+	for _, step := range s.plan {
+		if step.synthetic == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// stepDone follows the plan for a server message, it returns the message
+// that is relayed to the client, nil when nothing is relayed
+func (s *session) stepDone(server *pgxpool.Conn, msg pgproto3.BackendMessage) pgproto3.BackendMessage {
+	switch msg.(type) {
+	case *pgproto3.ErrorResponse:
+		if len(s.plan) > 0 && s.plan[0].failure != nil {
+			msg = s.plan[0].failure
+		}
+		// server ignores everything until Sync after an error, so statements
+		// of the failed and the ignored Parse messages are not created
+		s.plan = s.plan[:0]
+		s.dropPending()
+		return msg
+	case *pgproto3.ParseComplete, *pgproto3.BindComplete, *pgproto3.CloseComplete,
+		*pgproto3.RowDescription, *pgproto3.NoData, *pgproto3.CommandComplete,
+		*pgproto3.EmptyQueryResponse, *pgproto3.PortalSuspended:
+	default:
+		return msg
+	}
+	if len(s.plan) == 0 {
+		// simple query protocol
+		return msg
+	}
+	step := s.plan[0]
+	s.plan = s.plan[1:]
+	if step.parsed != nil {
+		step.parsed.pending = false
+	}
+	if step.prepared != "" || step.closed != "" {
+		statements := statementsOf(server.Conn().PgConn())
+		if step.prepared != "" {
+			statements.add(step.prepared)
+		}
+		if step.closed != "" {
+			statements.remove(step.closed)
+		}
+	}
+	if step.internal {
+		return nil
+	}
+	return msg
+}
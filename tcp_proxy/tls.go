@@ -0,0 +1,92 @@
+package tcpproxy
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"hash"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/mhkarimi1383/pg_pro/config"
+)
+
+var (
+	tlsConfig *tls.Config
+	// tlsRequired rejects clients that are not using TLS
+	tlsRequired bool
+	// tlsChannelBinding is the `tls-server-end-point` data of our
+	// certificate, used by SCRAM-SHA-256-PLUS
+	tlsChannelBinding []byte
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// loadTLSConfig prepares TLS termination of client connections, TLS is
+// disabled when no certificate is configured
+func loadTLSConfig() error {
+	certFile := config.GetString("tls.cert_file")
+	if certFile == "" {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, config.GetString("tls.key_file"))
+	if err != nil {
+		return errors.Wrap(err, "loading TLS certificate")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return errors.Wrap(err, "parsing TLS certificate")
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if v := config.GetString("tls.min_version"); v != "" {
+		version, ok := tlsVersions[v]
+		if !ok {
+			return errors.Errorf("invalid tls.min_version %q", v)
+		}
+		cfg.MinVersion = version
+	}
+	if caFile := config.GetString("tls.client_ca_file"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return errors.Wrap(err, "reading TLS client CA")
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return errors.New("no certificate found in tls.client_ca_file")
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	tlsConfig = cfg
+	tlsRequired = config.GetBool("tls.required")
+	tlsChannelBinding = certificateHash(leaf)
+	return nil
+}
+
+// certificateHash implements `tls-server-end-point` channel binding
+// (RFC 5929), md5 and sha1 signatures are upgraded to sha256
+func certificateHash(cert *x509.Certificate) []byte {
+	var h hash.Hash
+	switch cert.SignatureAlgorithm {
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384, x509.SHA384WithRSAPSS:
+		h = sha512.New384()
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512, x509.SHA512WithRSAPSS:
+		h = sha512.New()
+	default:
+		h = sha256.New()
+	}
+	h.Write(cert.Raw)
+	return h.Sum(nil)
+}
@@ -4,16 +4,25 @@ import (
 	"crypto/md5"
 	"fmt"
 	"os"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
 
-var MD5AuthSalt [4]byte = [4]byte{'1', '2', '3', '4'}
+type AuthMethod string
+
+const (
+	SCRAMSHA256AuthMethod AuthMethod = "scram-sha-256"
+	MD5AuthMethod         AuthMethod = "md5"
+)
 
 type YAMLFileAuthProviderConfigUser struct {
-	Superuser bool   `yaml:"superuser"`
-	Password  string `yaml:"password"`
-	Tables    []struct {
+	Superuser bool `yaml:"superuser"`
+	// Password could be plaintext, or a `SCRAM-SHA-256$...` verifier or a
+	// `md5...` hash (same as `pg_authid.rolpassword`)
+	Password   string     `yaml:"password"`
+	AuthMethod AuthMethod `yaml:"auth_method"`
+	Tables     []struct {
 		Name        string   `yaml:"name"`
 		Schema      string   `yaml:"schema"`
 		AccessModes []string `yaml:"access_modes"`
@@ -23,7 +32,8 @@ type YAMLFileAuthProviderConfigUser struct {
 type YAMLFileAuthProviderConfig map[string]YAMLFileAuthProviderConfigUser
 
 type YAMLFileAuthProvider struct {
-	config YAMLFileAuthProviderConfig
+	config    YAMLFileAuthProviderConfig
+	verifiers map[string]*SCRAMVerifier
 }
 
 func (p *YAMLFileAuthProvider) SetConfig(configFilePath string) error {
@@ -36,7 +46,37 @@ func (p *YAMLFileAuthProvider) SetConfig(configFilePath string) error {
 	if err != nil {
 		return err
 	}
+
+	verifiers := map[string]*SCRAMVerifier{}
+	for username, user := range *cfg {
+		switch user.AuthMethod {
+		case "":
+			user.AuthMethod = SCRAMSHA256AuthMethod
+			(*cfg)[username] = user
+		case SCRAMSHA256AuthMethod, MD5AuthMethod:
+		default:
+			return fmt.Errorf("invalid auth_method %q for user %v", user.AuthMethod, username)
+		}
+
+		var verifier *SCRAMVerifier
+		switch {
+		case strings.HasPrefix(user.Password, scramPrefix+"$"):
+			verifier, err = ParseSCRAMVerifier(user.Password)
+		case isMD5Hash(user.Password):
+			if user.AuthMethod != MD5AuthMethod {
+				return fmt.Errorf("user %v has a md5 hashed password, but does not use md5 auth_method", username)
+			}
+		default:
+			verifier, err = NewSCRAMVerifier(user.Password)
+		}
+		if err != nil {
+			return fmt.Errorf("password of user %v: %w", username, err)
+		}
+		verifiers[username] = verifier
+	}
+
 	p.config = *cfg
+	p.verifiers = verifiers
 	return nil
 }
 
@@ -46,14 +86,49 @@ func md5s(s string) string {
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
-func encodeMD5Password(username, password, salt string) string {
-	hashedCreds := md5s(username + password)
-	return "md5" + md5s(hashedCreds+salt)
+func isMD5Hash(s string) bool {
+	if len(s) != 35 || !strings.HasPrefix(s, "md5") {
+		return false
+	}
+	for _, c := range s[3:] {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeMD5Password returns the value stored by postgres for md5 passwords
+func encodeMD5Password(username, password string) string {
+	if isMD5Hash(password) {
+		return password
+	}
+	return "md5" + md5s(password+username)
 }
 
-func (p *YAMLFileAuthProvider) CheckAuth(username, password string) bool {
-	md5Pass := encodeMD5Password(p.config[username].Password, username, string(MD5AuthSalt[:]))
-	return md5Pass == password
+func (p *YAMLFileAuthProvider) AuthMethod(username string) AuthMethod {
+	if user, ok := p.config[username]; ok {
+		return user.AuthMethod
+	}
+	return SCRAMSHA256AuthMethod
+}
+
+func (p *YAMLFileAuthProvider) CheckMD5Auth(username, response string, salt [4]byte) bool {
+	user, ok := p.config[username]
+	if !ok || user.AuthMethod != MD5AuthMethod || strings.HasPrefix(user.Password, scramPrefix+"$") {
+		return false
+	}
+	hashedCreds := encodeMD5Password(username, user.Password)
+	return "md5"+md5s(hashedCreds[3:]+string(salt[:])) == response
+}
+
+func (p *YAMLFileAuthProvider) GetSCRAMVerifier(username string) (*SCRAMVerifier, bool) {
+	user, ok := p.config[username]
+	if !ok || user.AuthMethod != SCRAMSHA256AuthMethod {
+		return nil, false
+	}
+	verifier, ok := p.verifiers[username]
+	return verifier, ok && verifier != nil
 }
 
 func (p *YAMLFileAuthProvider) CheckAccess(accessInfo TableAccessInfo, username string) bool {
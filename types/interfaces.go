@@ -2,6 +2,11 @@ package types
 
 type AuthProvider interface {
 	CheckAccess(accessInfo TableAccessInfo, username string) bool
-	CheckAuth(username, password string) bool
+	// AuthMethod is the method that client has to use for authentication
+	AuthMethod(username string) AuthMethod
+	// CheckMD5Auth validates the md5 response of the client for the given salt
+	CheckMD5Auth(username, response string, salt [4]byte) bool
+	// GetSCRAMVerifier returns the stored SCRAM-SHA-256 secret of the user
+	GetSCRAMVerifier(username string) (*SCRAMVerifier, bool)
 	IsSuperUser(username string) bool
 }
@@ -0,0 +1,117 @@
+package types
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	scramPrefix           = "SCRAM-SHA-256"
+	scramDefaultIteration = 4096
+	scramSaltLength       = 16
+)
+
+// SCRAMVerifier is the stored SCRAM-SHA-256 secret of a user, same as what
+// postgres keeps in `pg_authid.rolpassword`
+type SCRAMVerifier struct {
+	Iterations int
+	Salt       []byte
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewSCRAMVerifier derives a verifier from a plaintext password using a
+// random salt
+func NewSCRAMVerifier(password string) (*SCRAMVerifier, error) {
+	salt := make([]byte, scramSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	saltedPassword := pbkdf2.Key([]byte(password), salt, scramDefaultIteration, sha256.Size, sha256.New)
+	clientKey := scramHMAC(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	return &SCRAMVerifier{
+		Iterations: scramDefaultIteration,
+		Salt:       salt,
+		StoredKey:  storedKey[:],
+		ServerKey:  scramHMAC(saltedPassword, "Server Key"),
+	}, nil
+}
+
+// NewMockSCRAMVerifier returns the verifier of users that do not exist, like
+// `scram_mock_salt` of postgres its salt only depends on the username and a
+// secret of the process, so attempts for unknown users look like attempts for
+// existing ones
+func NewMockSCRAMVerifier(secret []byte, username string) *SCRAMVerifier {
+	return &SCRAMVerifier{
+		Iterations: scramDefaultIteration,
+		Salt:       scramHMAC(secret, "salt "+username)[:scramSaltLength],
+		StoredKey:  scramHMAC(secret, "stored key "+username),
+		ServerKey:  scramHMAC(secret, "server key "+username),
+	}
+}
+
+// ParseSCRAMVerifier parses verifiers in the
+// `SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>` format
+func ParseSCRAMVerifier(s string) (*SCRAMVerifier, error) {
+	invalid := fmt.Errorf("invalid SCRAM-SHA-256 verifier")
+	parts := strings.Split(s, "$")
+	if len(parts) != 3 || parts[0] != scramPrefix {
+		return nil, invalid
+	}
+	iterationAndSalt := strings.SplitN(parts[1], ":", 2)
+	keys := strings.SplitN(parts[2], ":", 2)
+	if len(iterationAndSalt) != 2 || len(keys) != 2 {
+		return nil, invalid
+	}
+
+	var err error
+	v := new(SCRAMVerifier)
+	if v.Iterations, err = strconv.Atoi(iterationAndSalt[0]); err != nil || v.Iterations < 1 {
+		return nil, invalid
+	}
+	if v.Salt, err = base64.StdEncoding.DecodeString(iterationAndSalt[1]); err != nil {
+		return nil, invalid
+	}
+	if v.StoredKey, err = base64.StdEncoding.DecodeString(keys[0]); err != nil || len(v.StoredKey) != sha256.Size {
+		return nil, invalid
+	}
+	if v.ServerKey, err = base64.StdEncoding.DecodeString(keys[1]); err != nil || len(v.ServerKey) != sha256.Size {
+		return nil, invalid
+	}
+	return v, nil
+}
+
+func (v *SCRAMVerifier) String() string {
+	return fmt.Sprintf(
+		"%v$%v:%v$%v:%v",
+		scramPrefix,
+		v.Iterations,
+		base64.StdEncoding.EncodeToString(v.Salt),
+		base64.StdEncoding.EncodeToString(v.StoredKey),
+		base64.StdEncoding.EncodeToString(v.ServerKey),
+	)
+}
+
+// ClientSignature is used by the server to validate proof of the client
+func (v *SCRAMVerifier) ClientSignature(authMessage string) []byte {
+	return scramHMAC(v.StoredKey, authMessage)
+}
+
+// ServerSignature is sent to the client to prove that server knows the secret
+func (v *SCRAMVerifier) ServerSignature(authMessage string) []byte {
+	return scramHMAC(v.ServerKey, authMessage)
+}
+
+func scramHMAC(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
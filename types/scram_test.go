@@ -0,0 +1,35 @@
+package types
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNewMockSCRAMVerifier(t *testing.T) {
+	secret := []byte("secret")
+	tests := []struct {
+		name     string
+		secret   []byte
+		username string
+		sameSalt bool
+	}{
+		{name: "same user", secret: secret, username: "user", sameSalt: true},
+		{name: "other user", secret: secret, username: "other", sameSalt: false},
+		{name: "other secret", secret: []byte("other secret"), username: "user", sameSalt: false},
+	}
+	reference := NewMockSCRAMVerifier(secret, "user")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewMockSCRAMVerifier(tt.secret, tt.username)
+			if len(v.Salt) != scramSaltLength {
+				t.Fatalf("salt length = %v, want %v", len(v.Salt), scramSaltLength)
+			}
+			if v.Iterations != scramDefaultIteration {
+				t.Fatalf("iterations = %v, want %v", v.Iterations, scramDefaultIteration)
+			}
+			if got := bytes.Equal(v.Salt, reference.Salt); got != tt.sameSalt {
+				t.Fatalf("same salt = %v, want %v", got, tt.sameSalt)
+			}
+		})
+	}
+}
@@ -65,3 +65,55 @@ func SchemaNameFixer(name string) string {
 	}
 	return name
 }
+
+// QueryHint is a `/* pg_pro:<name> key=value ... */` comment inside a query,
+// used for per-query overrides
+type QueryHint struct {
+	Name    string
+	Options map[string]string
+}
+
+// VariableSet is a statement changing a session variable
+type VariableSet struct {
+	// Name is the variable name (e.g. `search_path` or `role`), it is empty
+	// when every variable is reset
+	Name string
+	// Statement is the normalized statement, used for replaying it
+	Statement string
+	Local     bool
+	Reset     bool
+	ResetAll  bool
+}
+
+// Prepare is a `PREPARE` or `DEALLOCATE` statement, prepared statements
+// created by SQL live in the session like variables
+type Prepare struct {
+	// Name is the statement name, it is empty when every statement is
+	// deallocated
+	Name string
+	// Statement is the normalized `PREPARE` statement, used for replaying it
+	Statement     string
+	Deallocate    bool
+	DeallocateAll bool
+}
+
+// QueryTraits are properties of a query that affect caching and routing
+type QueryTraits struct {
+	// Cacheable is false when results of the query could change without any
+	// write (e.g. `now()` or `random()`)
+	Cacheable bool
+	// RequiresMaster is set for reads with side effects (e.g. `nextval()` or
+	// `FOR UPDATE`)
+	RequiresMaster bool
+	// Writes are tables modified by data-modifying CTEs and `SELECT INTO`
+	Writes []TableAccessInfo
+	// SessionState is set for queries leaving state in the server session
+	// that could not be replayed (temporary tables, LISTEN, session level
+	// advisory locks, ...), their connections are reset before other
+	// clients use them
+	SessionState bool
+	// SuperuserOnly is set for statements accessing files or programs of
+	// the server (`COPY ... PROGRAM` or `COPY ... FILE`), they run with
+	// privileges of pg_pro itself
+	SuperuserOnly bool
+}